@@ -0,0 +1,78 @@
+package birpc
+
+import (
+	"strings"
+)
+
+// Policy decides whether a peer may call a method. p is nil for
+// peers that have not been authenticated.
+type Policy interface {
+	Allow(p *Principal, method string) bool
+}
+
+// PolicyFunc adapts a function to a Policy.
+type PolicyFunc func(p *Principal, method string) bool
+
+func (f PolicyFunc) Allow(p *Principal, method string) bool {
+	return f(p, method)
+}
+
+// Authenticated allows any authenticated peer.
+func Authenticated() Policy {
+	return PolicyFunc(func(p *Principal, method string) bool {
+		return p != nil
+	})
+}
+
+// RequireRole allows peers that have any of the given roles.
+func RequireRole(roles ...string) Policy {
+	return PolicyFunc(func(p *Principal, method string) bool {
+		for _, role := range roles {
+			if p.HasRole(role) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Authorize restricts the methods matching pattern to peers allowed
+// by policy. The pattern is either SERVICE.METHOD, SERVICE.* for all
+// methods of a service, or * for everything. The most specific
+// pattern matching a method applies; methods matching no pattern can
+// be called by anyone.
+//
+// Calls that are not allowed fail with CodePermissionDenied, and the
+// method is left out of getMethods. This happens whether or not the
+// method exists, so callers can't find out which ones do.
+func (r *Registry) Authorize(pattern string, policy Policy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.policies == nil {
+		r.policies = make(map[string]Policy)
+	}
+	r.policies[pattern] = policy
+}
+
+// allowed reports whether p may call method; r.mu must be held for
+// reading.
+func (r *Registry) allowed(p *Principal, method string) bool {
+	if len(r.policies) == 0 {
+		return true
+	}
+	for _, pattern := range patterns(method) {
+		if policy, ok := r.policies[pattern]; ok {
+			return policy.Allow(p, method)
+		}
+	}
+	return true
+}
+
+// patterns returns the patterns that match method, most specific
+// first.
+func patterns(method string) []string {
+	if i := strings.LastIndex(method, "."); i >= 0 {
+		return []string{method, method[:i] + ".*", "*"}
+	}
+	return []string{method, "*"}
+}
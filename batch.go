@@ -0,0 +1,138 @@
+package birpc
+
+import (
+	"sync"
+	"time"
+)
+
+// maxBatch is the most messages sent in one batch; a full batch is
+// sent right away.
+const maxBatch = 64
+
+// BatchWriter is an optional interface that a Codec may implement,
+// to send several messages at once, for example as one JSON array.
+// Codecs implementing it must also read such batches.
+type BatchWriter interface {
+	WriteBatch([]*Message) error
+}
+
+// batch is a set of messages waiting to be sent together.
+type batch struct {
+	msgs []*Message
+}
+
+type batcher struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	current *batch
+	// batches being sent, signalled on sent
+	sending int
+	sent    *sync.Cond
+}
+
+// SetBatchWindow makes the Endpoint hold outgoing messages for up to
+// window, and send the messages queued meanwhile as one batch. This
+// trades latency for fewer frames when sending many small messages.
+// Sending does not wait for the batch to go out; if writing it fails,
+// the connection is closed and Serve returns the error.
+//
+// Batching needs a Codec that implements BatchWriter, and a peer
+// that announced FeatureBatch in the handshake, see SetHello; until
+// then, messages are sent one by one.
+//
+// Must be called before Serve.
+func (e *Endpoint) SetBatchWindow(window time.Duration) {
+	e.batcher.window = window
+}
+
+// batching reports whether outgoing messages should be batched.
+func (e *Endpoint) batching() (BatchWriter, bool) {
+	if e.batcher.window <= 0 {
+		return nil, false
+	}
+	w, ok := e.codec.(BatchWriter)
+	if !ok {
+		return nil, false
+	}
+	e.handshake.mu.Lock()
+	caps := e.handshake.caps
+	e.handshake.mu.Unlock()
+	return w, caps != nil && caps.Has(FeatureBatch)
+}
+
+// sendBatched queues msg in the current batch, without waiting for
+// it to be sent: it is also used by the read loop, which must not
+// stall for the batch window. The batch is sent from another
+// goroutine; as there is nobody left to tell, failing to send it is
+// logged and closes the connection.
+func (e *Endpoint) sendBatched(w BatchWriter, msg *Message) error {
+	e.batcher.mu.Lock()
+	b := e.batcher.current
+	if b == nil {
+		b = &batch{}
+		e.batcher.current = b
+		time.AfterFunc(e.batcher.window, func() { e.flush(w, b) })
+	}
+	b.msgs = append(b.msgs, msg)
+	full := len(b.msgs) >= maxBatch
+	e.batcher.mu.Unlock()
+
+	if full {
+		go e.flush(w, b)
+	}
+	return nil
+}
+
+// flush sends b, unless that already happened.
+func (e *Endpoint) flush(w BatchWriter, b *batch) {
+	e.batcher.mu.Lock()
+	if e.batcher.current != b {
+		// already flushed
+		e.batcher.mu.Unlock()
+		return
+	}
+	e.batcher.current = nil
+	e.batcher.sending++
+	// nothing is added to b anymore
+	msgs := b.msgs
+	e.batcher.mu.Unlock()
+	defer func() {
+		e.batcher.mu.Lock()
+		e.batcher.sending--
+		e.batcher.sent.Broadcast()
+		e.batcher.mu.Unlock()
+	}()
+
+	var err error
+	if len(msgs) == 1 {
+		err = e.codec.WriteMessage(msgs[0])
+	} else {
+		err = w.WriteBatch(msgs)
+	}
+	if err != nil {
+		e.getLogger().Error("birpc: sending batch failed", "messages", len(msgs), "err", err)
+		select {
+		case e.dropErr <- err:
+		default:
+		}
+		e.codec.Close()
+	}
+}
+
+// flushAll sends the queued messages right away, and waits until all
+// batches have been sent, so that closing the connection loses none.
+func (e *Endpoint) flushAll() {
+	e.batcher.mu.Lock()
+	b := e.batcher.current
+	e.batcher.mu.Unlock()
+	if b != nil {
+		// only BatchWriters batch
+		e.flush(e.codec.(BatchWriter), b)
+	}
+	e.batcher.mu.Lock()
+	for e.batcher.sending > 0 {
+		e.batcher.sent.Wait()
+	}
+	e.batcher.mu.Unlock()
+}
@@ -5,7 +5,7 @@
 //
 // - fully bidirectional: server can call RPCs on the client
 // - incoming messages with seq 0 are "untagged" and will not
-//   be responded to
+//   be responded to, unless refused
 //
 // This allows one to do RPC over websockets without sacrifing what
 // they are good for: sending immediate notifications.
@@ -16,11 +16,11 @@
 package birpc
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/rpc"
 	"reflect"
 	"sync"
@@ -32,11 +32,24 @@ var (
 	pingPeriod = 10 * time.Second
 )
 
+var (
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
 type function struct {
 	receiver reflect.Value
 	method   reflect.Method
-	args     reflect.Type
-	reply    reflect.Type
+	// context is set if the first parameter is a context.Context.
+	context bool
+	// args is nil if the method takes no args.
+	args reflect.Type
+	// reply is nil if the method has no reply.
+	reply reflect.Type
+	// replyArg is set if reply is passed in as a pointer, and
+	// extra arguments may follow it. Otherwise the method returns
+	// reply as its first return value.
+	replyArg bool
 }
 
 // Registry is a collection of services have methods that can be called remotely.
@@ -49,12 +62,112 @@ type Registry struct {
 	// protects services
 	mu        sync.RWMutex
 	functions map[string]*function
+	strict    bool
+	collector Collector
+	logger    Logger
+	// by pattern, see Authorize
+	policies map[string]Policy
+	// by pattern, see LimitMethod
+	methodLimits     map[string]Limit
+	principalLimit   *Limit
+	principalBuckets map[string]*tokenBucket
+	// prune principalBuckets when they get this many
+	principalPrune int
+	// see OnConnect and OnDisconnect
+	onConnect    []func(*Endpoint)
+	onDisconnect []func(*Endpoint, error)
+}
+
+// MethodError describes an exported method of a service that cannot
+// be called remotely, and why.
+type MethodError struct {
+	// Type is the Go type of the service, as in %T.
+	Type string
+	// Method is the name of the method.
+	Method string
+	// Reason is a short explanation, such as "must return error".
+	Reason string
+}
+
+func (e *MethodError) Error() string {
+	return fmt.Sprintf("birpc.RegisterService: method %s.%s %s", e.Type, e.Method, e.Reason)
 }
 
-func getRPCMethodsOfType(object interface{}) ([]*function, error) {
+// RegistrationError is returned by RegisterService and
+// RegisterServiceWithName when exported methods of the service were
+// skipped. Use errors.As to inspect the individual problems.
+//
+// Unless the Registry is strict, the usable methods were registered
+// even though an error is returned; check Registered to tell.
+type RegistrationError struct {
+	// Type is the Go type of the service, as in %T.
+	Type string
+	// Methods lists every skipped method and the reason.
+	Methods []*MethodError
+	// Registered is true if the usable methods of the service were
+	// registered despite the problems.
+	Registered bool
+}
+
+func (e *RegistrationError) Error() string {
+	var buf bytes.Buffer
+	if len(e.Methods) == 1 && e.Registered {
+		return e.Methods[0].Error()
+	}
+	if e.Registered {
+		fmt.Fprintf(&buf, "birpc.RegisterService: type %s has %d unusable methods", e.Type, len(e.Methods))
+	} else {
+		fmt.Fprintf(&buf, "birpc.RegisterService: type %s was not registered", e.Type)
+	}
+	for i, m := range e.Methods {
+		if i == 0 {
+			buf.WriteString(": ")
+		} else {
+			buf.WriteString("; ")
+		}
+		fmt.Fprintf(&buf, "%s %s", m.Method, m.Reason)
+	}
+	return buf.String()
+}
+
+// Unwrap returns the individual method problems.
+func (e *RegistrationError) Unwrap() []error {
+	errs := make([]error, len(e.Methods))
+	for i, m := range e.Methods {
+		errs[i] = m
+	}
+	return errs
+}
+
+// NonRPCer is an optional interface for services that have exported
+// methods which are intentionally not callable remotely. The methods
+// named by NonRPCMethods are skipped without being reported as
+// problems. NonRPCMethods itself is never an RPC method.
+type NonRPCer interface {
+	NonRPCMethods() []string
+}
+
+func getRPCMethodsOfType(object interface{}) ([]*function, []*MethodError) {
 	var fns []*function
+	var problems []*MethodError
 
 	type_ := reflect.TypeOf(object)
+	typeName := fmt.Sprintf("%T", object)
+
+	ignore := map[string]bool{"NonRPCMethods": true}
+	if n, ok := object.(NonRPCer); ok {
+		for _, name := range n.NonRPCMethods() {
+			ignore[name] = true
+		}
+	}
+
+	skip := func(method reflect.Method, reason string) {
+		problems = append(problems, &MethodError{
+			Type:   typeName,
+			Method: method.Name,
+			Reason: reason,
+		})
+	}
 
 	for i := 0; i < type_.NumMethod(); i++ {
 		method := type_.Method(i)
@@ -63,33 +176,50 @@ func getRPCMethodsOfType(object interface{}) ([]*function, error) {
 			// skip unexported method
 			continue
 		}
-		if method.Type.NumIn() < 3 {
-			fmt.Printf("birpc.RegisterService: method %T.%s is missing request/reply arguments\n", object, method.Name)
-			continue
-		}
-		if method.Type.In(2).Kind() != reflect.Ptr {
-			fmt.Printf("birpc.RegisterService: method %T.%s reply argument must be a pointer type\n", object, method.Name)
-			continue
-		}
-		var tmp error
-		if method.Type.NumOut() != 1 || method.Type.Out(0) != reflect.TypeOf(&tmp).Elem() {
-			fmt.Printf("birpc.RegisterService: method %T.%s must return error", object, method.Name)
+		if ignore[method.Name] {
 			continue
 		}
-
 		fn := &function{
 			receiver: reflect.ValueOf(object),
 			method:   method,
-			args:     method.Type.In(1),
-			reply:    method.Type.In(2).Elem(),
+		}
+		first := 1
+		if method.Type.NumIn() > first && method.Type.In(first) == contextType {
+			fn.context = true
+			first++
+		}
+		params := method.Type.NumIn() - first
+		returnsError := method.Type.NumOut() == 1 && method.Type.Out(0) == errorType
+		returnsReply := method.Type.NumOut() == 2 && method.Type.Out(1) == errorType
+
+		switch {
+		case params >= 2:
+			if method.Type.In(first+1).Kind() != reflect.Ptr {
+				skip(method, "reply argument must be a pointer type")
+				continue
+			}
+			if !returnsError {
+				skip(method, "must return error")
+				continue
+			}
+			fn.args = method.Type.In(first)
+			fn.reply = method.Type.In(first + 1).Elem()
+			fn.replyArg = true
+		case params == 1 && returnsError:
+			fn.args = method.Type.In(first)
+		case returnsReply:
+			if params == 1 {
+				fn.args = method.Type.In(first)
+			}
+			fn.reply = method.Type.Out(0)
+		default:
+			skip(method, "is missing request/reply arguments")
+			continue
 		}
 		fns = append(fns, fn)
 	}
 
-	if len(fns) == 0 {
-		return nil, fmt.Errorf("birpc.RegisterService: type %T has no exported methods of suitable type", object)
-	}
-	return fns, nil
+	return fns, problems
 }
 
 // RegisterServiceWithName registers all exported methods of service, allowing
@@ -107,21 +237,61 @@ func getRPCMethodsOfType(object interface{}) ([]*function, error) {
 // types are known to birpc and the codec in use.
 //
 // The methods should have return type error.
+//
+// The following shapes are accepted as well, where ctx is an
+// optional context.Context that is canceled when the Endpoint stops
+// serving:
+//
+//	func(ctx, args, *reply, extras...) error
+//	func(ctx, args) (Reply, error)
+//	func(ctx) (Reply, error)
+//	func(ctx, args) error
+//
+// Methods returning only an error send an empty result. The wire
+// format is the same for all shapes.
+//
+// Exported methods that do not fit are skipped, and reported in a
+// *RegistrationError. If the Registry is strict, or no method is
+// usable, nothing is registered. Services can exclude helper methods
+// from this check by implementing NonRPCer.
 func (r *Registry) RegisterServiceWithName(object interface{}, serviceName string) error {
-	methods, err := getRPCMethodsOfType(object)
-	if err != nil {
-		return err
-	}
+	methods, problems := getRPCMethodsOfType(object)
 	if serviceName == "" {
 		serviceName = reflect.Indirect(reflect.ValueOf(object)).Type().Name()
 	}
 
 	r.mu.Lock()
-	defer r.mu.Unlock()
+	logger := r.getLogger()
+	refused := len(problems) > 0 && (r.strict || len(methods) == 0)
+	if !refused {
+		for _, fn := range methods {
+			name := serviceName + "." + fn.method.Name
+			r.functions[name] = fn
+		}
+	}
+	r.mu.Unlock()
 
-	for _, fn := range methods {
-		name := serviceName + "." + fn.method.Name
-		r.functions[name] = fn
+	// log without holding r.mu, the Logger is user code
+	for _, p := range problems {
+		logger.Warn("birpc: skipping method", "type", p.Type, "method", p.Method, "reason", p.Reason)
+	}
+	if refused {
+		logger.Error("birpc: service not registered", "type", fmt.Sprintf("%T", object))
+		return &RegistrationError{
+			Type:    fmt.Sprintf("%T", object),
+			Methods: problems,
+		}
+	}
+	if len(methods) == 0 {
+		logger.Error("birpc: service has no methods", "type", fmt.Sprintf("%T", object))
+		return fmt.Errorf("birpc.RegisterService: type %T has no exported methods of suitable type", object)
+	}
+	if len(problems) > 0 {
+		return &RegistrationError{
+			Type:       fmt.Sprintf("%T", object),
+			Methods:    problems,
+			Registered: true,
+		}
 	}
 	return nil
 }
@@ -131,6 +301,15 @@ func (r *Registry) RegisterService(object interface{}) error {
 	return r.RegisterServiceWithName(object, "")
 }
 
+// SetStrict controls whether a service with any unusable exported
+// method is rejected as a whole. By default, the usable methods are
+// registered and the rest are only reported.
+func (r *Registry) SetStrict(strict bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.strict = strict
+}
+
 // NewRegistry creates a new Registry.
 func NewRegistry() *Registry {
 	r := &Registry{}
@@ -179,18 +358,81 @@ type Endpoint struct {
 		// protects seq and pending
 		mutex   sync.Mutex
 		seq     uint64
-		pending map[uint64]*rpc.Call
+		pending map[uint64]*pendingCall
 	}
 
 	server struct {
 		registry *Registry
+		// protects stopping, so no call starts once running is
+		// waited for
+		mu       sync.Mutex
+		stopping bool
 		running  sync.WaitGroup
 	}
 
+	// ctx is passed to methods that take a context.Context, and
+	// canceled when Serve returns.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	channels struct {
+		sync.Mutex
+		m map[string]*channelCodec
+	}
+
+	session Session
+
+	lifecycle struct {
+		sync.Mutex
+		onConnect    []func(*Endpoint)
+		onDisconnect []func(*Endpoint, error)
+		done         chan struct{}
+		err          error
+	}
+
+	// dropErr holds why a response was dropped, returned by Serve
+	// in place of the read error that follows
+	dropErr chan error
+
+	handshake handshake
+	batcher   batcher
+
+	principal struct {
+		sync.Mutex
+		p *Principal
+	}
+
+	limits struct {
+		all *tokenBucket
+		// protects methods
+		mu      sync.Mutex
+		methods map[string]*tokenBucket
+	}
+
+	// exporter receives spans, if set
+	exporter Exporter
+	// overrides the Collector of the Registry, if set
+	collector Collector
+	// overrides the Logger of the Registry, if set
+	logger Logger
+
+	lastPingTimestamp int64 // atomic, in nanoseconds
+
 	lastPongTimestamp int64 // atomic
 	seqID             uint64
 }
 
+// pendingCall is an outgoing call waiting for its response.
+type pendingCall struct {
+	call *rpc.Call
+	// where to store the metadata and error of the response, if
+	// wanted
+	responseMeta  *Metadata
+	responseError *Error
+	// may be nil
+	span *Span
+}
+
 // Dummy registry with no functions registered.
 var dummyRegistry = NewRegistry()
 
@@ -205,18 +447,38 @@ func NewEndpoint(codec Codec, registry *Registry) *Endpoint {
 	e := &Endpoint{}
 	e.codec = codec
 	e.server.registry = registry
-	e.client.pending = make(map[uint64]*rpc.Call)
+	e.client.pending = make(map[uint64]*pendingCall)
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	e.handshake.done = make(chan struct{})
+	e.dropErr = make(chan error, 1)
+	e.batcher.sent = sync.NewCond(&e.batcher.mu)
+	e.lifecycle.done = make(chan struct{})
 	e.lastPongTimestamp = time.Now().Unix()
 	e.seqID = 0
 	return e
 }
 
 func (e *Endpoint) serve_request(msg *Message) error {
+	info := &CallInfo{
+		Method:       msg.Func,
+		ID:           msg.ID,
+		Meta:         msg.Meta,
+		ResponseMeta: Metadata{},
+	}
+	// request metadata is not echoed back
+	msg.Meta = nil
+
+	if msg.Func == HelloMethod {
+		return e.serveHello(msg)
+	}
 	if msg.Func == "getMethods" {
+		principal := e.Principal()
 		e.server.registry.mu.RLock()
 		funcs := make([]string, 0, len(e.server.registry.functions))
 		for k := range e.server.registry.functions {
-			funcs = append(funcs, k)
+			if e.server.registry.allowed(principal, k) {
+				funcs = append(funcs, k)
+			}
 		}
 		e.server.registry.mu.RUnlock()
 		msg.Error = nil
@@ -227,38 +489,122 @@ func (e *Endpoint) serve_request(msg *Message) error {
 	}
 	e.server.registry.mu.RLock()
 	fn := e.server.registry.functions[msg.Func]
+	allowed := e.server.registry.allowed(e.Principal(), msg.Func)
 	e.server.registry.mu.RUnlock()
+	// before looking at fn, so callers can't probe for methods they
+	// may not call
+	if !allowed {
+		e.getLogger().Info("birpc: permission denied", "method", info.Method, "id", msg.ID)
+		return e.reject(msg, &Error{Msg: "Permission denied.", Code: CodePermissionDenied})
+	}
 	if fn == nil {
-		msg.Error = &Error{Msg: "No such function."}
-		msg.Func = ""
-		msg.Args = nil
-		msg.Result = nil
-		err := e.send(msg)
-		if err != nil {
-			// well, we can't report the problem to the client...
-			return err
+		return e.reject(msg, &Error{Msg: "No such function.", Code: CodeMethodNotFound})
+	}
+	wait, ok := e.rateLimit(msg.Func)
+	if !ok {
+		e.getLogger().Info("birpc: rate limited", "method", info.Method, "id", msg.ID)
+		if c, ok := e.getCollector().(RejectCollector); ok {
+			c.CallRejected(info.Method)
 		}
-		return nil
+		return e.reject(msg, &Error{Msg: "Rate limit exceeded.", Code: CodeRateLimited})
 	}
 
-	e.server.running.Add(1)
+	if !e.startCall() {
+		// Serve is returning, nobody would get the response
+		return nil
+	}
 	go func(fn *function, msg *Message) {
 		defer e.server.running.Done()
-		e.call(fn, msg)
+		// delayed calls wait here, not in the read loop
+		if !e.delay(wait) {
+			return
+		}
+		e.call(fn, msg, info)
 	}(fn, msg)
 	return nil
 }
 
+// startCall counts a method call as running, unless Serve is
+// returning.
+func (e *Endpoint) startCall() bool {
+	e.server.mu.Lock()
+	defer e.server.mu.Unlock()
+	if e.server.stopping {
+		return false
+	}
+	e.server.running.Add(1)
+	return true
+}
+
+// stopCalls makes startCall fail, and waits for the running calls.
+func (e *Endpoint) stopCalls() {
+	e.server.mu.Lock()
+	e.server.stopping = true
+	e.server.mu.Unlock()
+	e.server.running.Wait()
+}
+
+// reject answers the request msg with an error, without calling
+// anything. Untagged requests are refused too, so the peer can tell
+// they were not understood; the compression offer of jsonmsg relies
+// on that.
+func (e *Endpoint) reject(msg *Message, rpcErr *Error) error {
+	method := msg.Func
+	msg.Error = rpcErr
+	msg.Func = ""
+	msg.Args = nil
+	msg.Result = nil
+	err := e.send(msg)
+	if err != nil {
+		// well, we can't report the problem to the client...
+		e.getLogger().Error("birpc: dropping response", "method", method, "id", msg.ID, "err", err)
+		return err
+	}
+	return nil
+}
+
+// Respond answers the request id outside of any registered function:
+// with rpcErr if it is not nil, else with result. The response is sent
+// like those of Serve, so the code of rpcErr only reaches peers that
+// can take it, and batching applies. It is meant for codecs that
+// serve some requests themselves, such as a login in front of the
+// Registry.
+func (e *Endpoint) Respond(id uint64, result interface{}, rpcErr *Error) error {
+	msg := &Message{ID: id}
+	if rpcErr != nil {
+		return e.reject(msg, rpcErr)
+	}
+	msg.Result = result
+	return e.send(msg)
+}
+
 func (e *Endpoint) serve_response(msg *Message) error {
+	if msg.ID == 0 {
+		// the peer answered an untagged request, see Notify
+		return nil
+	}
 	e.client.mutex.Lock()
-	call, found := e.client.pending[msg.ID]
+	pending, found := e.client.pending[msg.ID]
 	delete(e.client.pending, msg.ID)
+	if found {
+		// while the call is still pending, so the caller can't
+		// have given up and returned; see forget
+		if pending.responseMeta != nil {
+			*pending.responseMeta = msg.Meta
+		}
+		if pending.responseError != nil && msg.Error != nil {
+			*pending.responseError = *msg.Error
+		}
+	}
 	e.client.mutex.Unlock()
 
 	if !found {
+		e.getLogger().Warn("birpc: response with unknown id", "id", msg.ID)
 		return fmt.Errorf("Server responded with unknown seq %v", msg.ID)
 	}
 
+	call := pending.call
+
 	if msg.Error == nil {
 		if call.Reply != nil {
 			err := e.codec.UnmarshalResult(msg, call.Reply)
@@ -269,6 +615,7 @@ func (e *Endpoint) serve_response(msg *Message) error {
 	} else {
 		call.Error = rpc.ServerError(msg.Error.Msg)
 	}
+	e.endSpan(pending.span, call.Error)
 
 	// notify the caller, but never block
 	select {
@@ -281,39 +628,65 @@ func (e *Endpoint) serve_response(msg *Message) error {
 
 // Serve messages from this connection. Serve blocks, serving the
 // connection until the client disconnects, or there is an error.
-func (e *Endpoint) Serve() error {
+func (e *Endpoint) Serve() (err error) {
+	defer func() {
+		e.getLogger().Info("birpc: endpoint disconnected", "err", err)
+	}()
+	// after the methods have returned
+	defer func() {
+		e.finish(err)
+	}()
 	defer e.codec.Close()
-	defer e.server.running.Wait()
+	defer e.flushAll()
+	defer e.stopCalls()
+	defer e.cancel()
+	defer e.closeChannels()
+	defer e.endHandshake()
 
 	// avoid data race, setup before ReadMessage
 	e.codec.SetPingHandler(
 		func(string) error {
 			return e.codec.Pong()
 		})
+	collector := e.getCollector()
 	e.codec.SetPongHandler(
 		func(string) error {
-			now := time.Now().Unix()
-			atomic.StoreInt64(&e.lastPongTimestamp, now)
+			now := time.Now()
+			atomic.StoreInt64(&e.lastPongTimestamp, now.Unix())
+			if sent := atomic.LoadInt64(&e.lastPingTimestamp); collector != nil && sent != 0 {
+				collector.PingRTT(now.Sub(time.Unix(0, sent)))
+			}
 			return nil
 		})
+	if reporter, ok := e.codec.(SizeReporter); ok && collector != nil {
+		reporter.SetSizeHandler(collector.MessageSize)
+	}
 
 	pingpongError := make(chan error, 1)
-	go func() {
-		pingpongError <- func() error {
-			ticker := time.NewTicker(pingPeriod)
-			defer ticker.Stop()
-			for range ticker.C {
-				lastPongTimestamp := atomic.LoadInt64(&e.lastPongTimestamp)
-				if lastPongTimestamp+2*int64(pingPeriod.Seconds()) < time.Now().Unix() {
-					return errors.New("remote connection is timeout.")
-				}
-				if err := e.codec.Ping(); err != nil {
-					return errors.New("remote connection is closed.")
+	// channels rely on the pings of their connection
+	if _, ok := e.codec.(*channelCodec); !ok {
+		go func() {
+			pingpongError <- func() error {
+				ticker := time.NewTicker(pingPeriod)
+				defer ticker.Stop()
+				for range ticker.C {
+					lastPongTimestamp := atomic.LoadInt64(&e.lastPongTimestamp)
+					if lastPongTimestamp+2*int64(pingPeriod.Seconds()) < time.Now().Unix() {
+						return errors.New("remote connection is timeout.")
+					}
+					atomic.StoreInt64(&e.lastPingTimestamp, time.Now().UnixNano())
+					if err := e.codec.Ping(); err != nil {
+						var timeout *TimeoutError
+						if errors.As(err, &timeout) {
+							return err
+						}
+						return errors.New("remote connection is closed.")
+					}
 				}
-			}
-			return nil
+				return nil
+			}()
 		}()
-	}()
+	}
 
 	readError := make(chan error)
 	go func() {
@@ -321,6 +694,24 @@ func (e *Endpoint) Serve() error {
 			for {
 				var msg Message
 				err := e.codec.ReadMessage(&msg)
+				if err == nil && msg.Func != HelloMethod && e.handshake.hello == nil {
+					// the peer is not sending a hello first
+					e.endHandshake()
+				}
+				if err == nil && msg.Channel != "" {
+					if err := e.route(&msg); err != nil {
+						return err
+					}
+					continue
+				}
+				var reqErr *RequestError
+				if errors.As(err, &reqErr) {
+					msg = Message{ID: reqErr.ID, Func: reqErr.Func}
+					if err := e.reject(&msg, reqErr.Err); err != nil {
+						return err
+					}
+					continue
+				}
 				if err != nil {
 					return err
 				}
@@ -334,157 +725,331 @@ func (e *Endpoint) Serve() error {
 					return err
 				}
 			}
-			return nil
 		}()
 	}()
 
+	// OnConnect functions see the outcome of our hello
+	e.startCall()
+	go func() {
+		defer e.server.running.Done()
+		if e.handshake.hello != nil {
+			go e.sendHello()
+			select {
+			case <-e.handshake.done:
+			case <-e.ctx.Done():
+			}
+		}
+		e.connected()
+	}()
+
 	for {
 		select {
 		case err := <-pingpongError:
 			return err
 		case err := <-readError:
+			select {
+			case dropErr := <-e.dropErr:
+				return dropErr
+			default:
+			}
 			return err
 		}
 	}
-	return nil
 }
 
 func (e *Endpoint) send(msg *Message) error {
+	if msg.Error != nil && msg.Error.Code != 0 && !e.sendsErrorCodes() {
+		// legacy peers don't know codes
+		msg.Error = &Error{Msg: msg.Error.Msg}
+	}
+	if w, ok := e.batching(); ok {
+		return e.sendBatched(w, msg)
+	}
 	return e.codec.WriteMessage(msg)
 }
 
-func (e *Endpoint) fillArgs(arglist []reflect.Value) {
+// sendsErrorCodes reports whether Error.Code may be sent to the peer.
+func (e *Endpoint) sendsErrorCodes() bool {
+	if coder, ok := e.codec.(ErrorCoder); ok && coder.CarriesErrorCodes() {
+		return true
+	}
+	return e.Capabilities().Has(FeatureErrorCodes)
+}
+
+// dropped logs a response that could not be sent, and closes the
+// connection, as the peer would otherwise wait for it forever.
+func (e *Endpoint) dropped(msg *Message, method string, err error) {
+	e.getLogger().Error("birpc: dropping response", "method", method, "id", msg.ID, "err", err)
+	select {
+	case e.dropErr <- err:
+	default:
+	}
+	e.codec.Close()
+}
+
+// respond sends the response msg to a call of method. Untagged
+// requests are not answered: nobody waits for the response.
+func (e *Endpoint) respond(msg *Message, method string) {
+	if msg.ID == 0 {
+		return
+	}
+	err := e.send(msg)
+	var encErr *EncodeError
+	if errors.As(err, &encErr) && msg.Error == nil {
+		// nothing was written; the caller gets an error instead
+		e.getLogger().Error("birpc: can't encode result", "method", method, "id", msg.ID, "err", err)
+		msg.Result = nil
+		msg.Error = &Error{Msg: "Internal error.", Code: CodeInternalError}
+		err = e.send(msg)
+	}
+	if err != nil {
+		e.dropped(msg, method, err)
+	}
+}
+
+func (e *Endpoint) fillArgs(arglist []reflect.Value, info *CallInfo) {
 	for i := 0; i < len(arglist); i++ {
 		switch arglist[i].Interface().(type) {
 		case *Endpoint:
 			arglist[i] = reflect.ValueOf(e)
+		case *CallInfo:
+			arglist[i] = reflect.ValueOf(info)
+		case *Principal:
+			arglist[i] = reflect.ValueOf(e.Principal())
 		}
 	}
 }
 
-func (e *Endpoint) call(fn *function, msg *Message) {
-	var args reflect.Value
-	if fn.args.Kind() == reflect.Ptr {
-		args = reflect.New(fn.args.Elem())
-	} else {
-		args = reflect.New(fn.args)
+func (e *Endpoint) call(fn *function, msg *Message, info *CallInfo) {
+	num_args := fn.method.Type.NumIn()
+	arglist := make([]reflect.Value, 0, num_args)
+	arglist = append(arglist, fn.receiver)
+
+	span := e.serverSpan(info)
+	collector := e.getCollector()
+	start := time.Now()
+	if collector != nil {
+		collector.CallStarted(info.Method)
 	}
+	// the error sent to the peer, if any
+	var failed *Error
+	defer func() {
+		var err error
+		if failed != nil {
+			err = failed
+		}
+		e.endSpan(span, err)
+		if collector != nil {
+			collector.CallFinished(info.Method, failed, time.Since(start))
+		}
+	}()
 
-	err := e.codec.UnmarshalArgs(msg, args.Interface())
-	if err != nil {
-		msg.Error = &Error{Msg: err.Error()}
-		msg.Func = ""
-		msg.Args = nil
-		msg.Result = nil
-		err = e.send(msg)
-		if err != nil {
-			// well, we can't report the problem to the client...
-			e.codec.Close()
-			return
+	if fn.context {
+		ctx := context.WithValue(e.ctx, callInfoKey{}, info)
+		if span != nil {
+			ctx = ContextWithSpanContext(ctx, span.SpanContext)
 		}
-		return
-	}
-	if fn.args.Kind() != reflect.Ptr {
-		args = args.Elem()
+		arglist = append(arglist, reflect.ValueOf(ctx))
 	}
 
-	reply := reflect.New(fn.reply)
+	if fn.args != nil {
+		var args reflect.Value
+		if fn.args.Kind() == reflect.Ptr {
+			args = reflect.New(fn.args.Elem())
+		} else {
+			args = reflect.New(fn.args)
+		}
 
-	num_args := fn.method.Type.NumIn()
-	arglist := make([]reflect.Value, num_args, num_args)
+		err := e.codec.UnmarshalArgs(msg, args.Interface())
+		if err != nil {
+			msg.Error = &Error{Msg: err.Error(), Code: CodeInvalidParams}
+			failed = msg.Error
+			msg.Func = ""
+			msg.Args = nil
+			msg.Result = nil
+			e.respond(msg, info.Method)
+			return
+		}
+		if fn.args.Kind() != reflect.Ptr {
+			args = args.Elem()
+		}
+		arglist = append(arglist, args)
+	}
 
-	arglist[0] = fn.receiver
-	arglist[1] = args
-	arglist[2] = reply
+	var reply reflect.Value
+	if fn.replyArg {
+		reply = reflect.New(fn.reply)
+		arglist = append(arglist, reply)
+	}
 
-	if num_args > 3 {
-		for i := 3; i < num_args; i++ {
-			arglist[i] = reflect.Zero(fn.method.Type.In(i))
+	if extra := len(arglist); num_args > extra {
+		for i := extra; i < num_args; i++ {
+			arglist = append(arglist, reflect.Zero(fn.method.Type.In(i)))
 		}
 		// first fill what we can
-		e.fillArgs(arglist[3:])
+		e.fillArgs(arglist[extra:], info)
 
 		// then codec fills what it can
 		if filler, ok := e.codec.(FillArgser); ok {
-			err = filler.FillArgs(arglist[3:])
+			err := filler.FillArgs(arglist[extra:])
 			if err != nil {
 				msg.Error = &Error{Msg: err.Error()}
+				failed = msg.Error
 				msg.Func = ""
 				msg.Args = nil
 				msg.Result = nil
-				err = e.send(msg)
-				if err != nil {
-					// well, we can't report the problem to the client...
-					e.codec.Close()
-					return
-				}
+				e.respond(msg, info.Method)
 				return
 			}
 		}
 	}
 
 	retval := fn.method.Func.Call(arglist)
-	erri := retval[0].Interface()
+	if len(info.ResponseMeta) > 0 {
+		msg.Meta = info.ResponseMeta
+	}
+	erri := retval[len(retval)-1].Interface()
 	if erri != nil {
 		err := erri.(error)
-		msg.Error = &Error{Msg: err.Error()}
+		msg.Error = toError(err, 0)
+		failed = msg.Error
 		msg.Func = ""
 		msg.Args = nil
 		msg.Result = nil
-		err = e.send(msg)
-		if err != nil {
-			// well, we can't report the problem to the client...
-			e.codec.Close()
-			return
-		}
+		e.respond(msg, info.Method)
 		return
 	}
 
 	msg.Error = nil
 	msg.Func = ""
 	msg.Args = nil
-	msg.Result = reply.Interface()
-
-	err = e.send(msg)
-	if err != nil {
-		// well, we can't report the problem to the client...
-		e.codec.Close()
-		return
+	switch {
+	case fn.replyArg:
+		msg.Result = reply.Interface()
+	case fn.reply != nil:
+		msg.Result = retval[0].Interface()
+	default:
+		msg.Result = struct{}{}
 	}
+
+	e.respond(msg, info.Method)
 }
 
+// ErrUnbufferedDone is the error of calls started by Go with an
+// unbuffered done channel. Such calls are not sent.
+var ErrUnbufferedDone = errors.New("birpc: done channel is unbuffered")
+
 // Go invokes the function asynchronously. See net/rpc Client.Go.
+// Unlike there, an unbuffered done channel fails the call with
+// ErrUnbufferedDone instead of panicking.
 func (e *Endpoint) Go(function string, args interface{}, reply interface{}, done chan *rpc.Call) *rpc.Call {
-	call := &rpc.Call{}
-	call.ServiceMethod = function
-	call.Args = args
-	call.Reply = reply
 	if done == nil {
 		done = make(chan *rpc.Call, 10)
-	} else {
-		if cap(done) == 0 {
-			log.Panic("birpc: done channel is unbuffered")
+	} else if cap(done) == 0 {
+		e.getLogger().Error("birpc: done channel is unbuffered", "method", function)
+		call := &rpc.Call{
+			ServiceMethod: function,
+			Args:          args,
+			Reply:         reply,
+			Error:         ErrUnbufferedDone,
+			Done:          done,
 		}
+		// the caller can only receive after Go returns
+		go func() { done <- call }()
+		return call
 	}
-	call.Done = done
 
 	msg := &Message{
 		Func: function,
 		Args: args,
 	}
+	return e.start(context.Background(), msg, reply, done)
+}
+
+// Notify sends an untagged request, calling function on the peer
+// without waiting for, or expecting, a response. The peer only
+// answers to refuse it, for example when function does not exist;
+// such answers are ignored. Unlike Go, it blocks until the message is
+// written, or queued when batching, see SetBatchWindow.
+func (e *Endpoint) Notify(function string, args interface{}) error {
+	return e.send(&Message{Func: function, Args: args})
+}
+
+// start sends the request msg, assigning it an ID. The metadata and
+// error of the response are stored where ctx asks for them, see
+// WithResponseMetadata and WithResponseError. The call is traced as
+// part of the span in ctx, if any.
+func (e *Endpoint) start(ctx context.Context, msg *Message, reply interface{}, done chan *rpc.Call) *rpc.Call {
+	call := &rpc.Call{}
+	call.ServiceMethod = msg.Func
+	call.Args = msg.Args
+	call.Reply = reply
+	call.Done = done
+
+	respMeta, _ := ctx.Value(responseMetadataKey{}).(*Metadata)
+	respErr, _ := ctx.Value(responseErrorKey{}).(*Error)
+	span := e.clientSpan(ctx, msg)
 
 	e.client.mutex.Lock()
 	e.client.seq++
 	msg.ID = e.client.seq
-	e.client.pending[msg.ID] = call
+	if span != nil {
+		span.ID = msg.ID
+	}
+	e.client.pending[msg.ID] = &pendingCall{
+		call:          call,
+		responseMeta:  respMeta,
+		responseError: respErr,
+		span:          span,
+	}
 	e.client.mutex.Unlock()
 
 	// put sending in a goroutine so a malicious client that
 	// refuses to read cannot ever make a .Go call block
-	go e.send(msg)
+	go func() {
+		if err := e.send(msg); err != nil {
+			e.getLogger().Warn("birpc: sending request failed", "method", msg.Func, "id", msg.ID, "err", err)
+			e.fail(call, err)
+		}
+	}()
 	return call
 }
 
+// fail completes a pending call with err, unless it is already done.
+func (e *Endpoint) fail(call *rpc.Call, err error) {
+	if !e.forget(call, err) {
+		return
+	}
+	call.Error = err
+	// notify the caller, but never block
+	select {
+	case call.Done <- call:
+	default:
+	}
+}
+
+// forget drops a pending call, so a late response is ignored. err
+// is why the caller gave up. It reports whether the call was still
+// pending. Once it returns, the response metadata and error of the
+// call are not written any more.
+func (e *Endpoint) forget(call *rpc.Call, err error) bool {
+	e.client.mutex.Lock()
+	var pending *pendingCall
+	for k, v := range e.client.pending {
+		if v.call == call {
+			pending = v
+			delete(e.client.pending, k)
+			break
+		}
+	}
+	e.client.mutex.Unlock()
+	if pending == nil {
+		return false
+	}
+	e.endSpan(pending.span, err)
+	return true
+}
+
 // Call invokes the named function, waits for it to complete, and
 // returns its error status. See net/rpc Client.Call
 func (e *Endpoint) Call(function string, args interface{}, reply interface{}) error {
@@ -502,20 +1067,20 @@ func (e *Endpoint) CallWithDeadline(function string, args interface{}, reply int
 
 	select {
 	case <-ctx.Done():
-		e.client.mutex.Lock()
-		for k, v := range e.client.pending {
-			if v == call {
-				delete(e.client.pending, k)
-				break
-			}
-		}
-		e.client.mutex.Unlock()
-		return errors.New("birpc: call timeout, dont resend")
+		err := errors.New("birpc: call timeout, dont resend")
+		e.forget(call, err)
+		return err
 	case call := <-call.Done:
 		return call.Error
 	}
 }
 
+// Close closes the connection, making Serve return. For an Endpoint
+// returned by OpenChannel, only the channel is closed.
+func (e *Endpoint) Close() error {
+	return e.codec.Close()
+}
+
 func (e *Endpoint) SetPingHandler(handler func(string) error) {
 	e.codec.SetPingHandler(handler)
 }
@@ -6,6 +6,10 @@ function BirpcSocket(url) {
 	this.sequence = 0;
 	this.onReady = undefined;
 
+	// Answered to birpc.hello; see Hello in hello.go.
+	this.hello = { version: 1, features: ['error-codes', 'batch'] };
+	this.capabilities = { version: 0, features: [] };
+
 
 	this.onMethodsGot = (function (reply, err) {
 		if (err) {
@@ -42,25 +46,56 @@ function BirpcSocket(url) {
 
 	this.ws.onmessage = (function (e) {
 		//console.log(e);
-		var rpc = JSON.parse(e.data);
+		var data = JSON.parse(e.data);
+		if (Array.isArray(data)) {
+			// a batch, see Endpoint.SetBatchWindow
+			for (var rpc of data) {
+				this.handleMessage(rpc);
+			}
+		} else {
+			this.handleMessage(data);
+		}
+	}).bind(this);
 
+	this.handleMessage = (function (rpc) {
 		if (rpc.fn) {
 			var ret = { id: rpc.id };
-			if (rpc.fn == 'eval') {
+			if (rpc.ch) {
+				// answer on the same channel, see Endpoint.OpenChannel
+				ret.ch = rpc.ch;
+			}
+			if (rpc.fn == 'birpc.hello') {
+				var peer = rpc.args || {};
+				var offered = peer.features || [];
+				this.capabilities = {
+					version: Math.min(this.hello.version, peer.version || 0),
+					features: this.hello.features.filter(function (f) {
+						return offered.indexOf(f) >= 0;
+					}),
+					options: peer.options
+				};
+				ret.result = this.hello;
+			} else if (rpc.fn == 'eval') {
 				if (typeof (rpc.args) == 'string') {
 					console.log('eval by remote: ' + rpc.args);
 					ret.result = eval(rpc.args);
 				} else {
-					ret.error = 'eval none string type';
+					ret.error = { msg: 'eval none string type', code: -32602 };
 				}
 			} else {
 				var func = this.handlers[rpc.fn]
 				if (func == undefined) {
-					ret.error = 'Unknown method'
+					ret.error = { msg: 'Unknown method', code: -32601 };
 				} else {
-					ret.result = func(rpc.args);
+					// rpc.meta carries e.g. the traceparent of the Go caller;
+					// pass it on to continue the trace.
+					ret.result = func(rpc.args, rpc.meta);
 				}
 			}
+			if (!rpc.id) {
+				// untagged, see Endpoint.Notify; no answer expected
+				return;
+			}
 			//console.log("JS->:" + JSON.stringify(ret))
 			this.ws.send(JSON.stringify(ret));
 		} else {
@@ -79,6 +114,32 @@ function BirpcSocket(url) {
 		this.handlers[method] = fn;
 	}).bind(this);
 
+	// Subscriptions to pubsub topics, by filter; see package pubsub.
+	this.subscriptions = {};
+
+	this.subscribe = (function (filter, onMessage, cbk, timeout) {
+		this.subscriptions[filter] = onMessage;
+		this.registerMethod('PubSub.Deliver', (function (d) {
+			var onMessage = this.subscriptions[d.filter];
+			if (onMessage) {
+				onMessage(d.payload, d.topic);
+			}
+			return {};
+		}).bind(this));
+		this.call('PubSub.Subscribe', filter, cbk, timeout || 1000);
+	}).bind(this);
+
+	this.unsubscribe = (function (filter, cbk, timeout) {
+		delete this.subscriptions[filter];
+		this.call('PubSub.Unsubscribe', filter, cbk, timeout || 1000);
+	}).bind(this);
+
+	// Calls a method registered by another peer, through the server;
+	// see package relay.
+	this.relay = (function (to, method, args, cbk, timeout) {
+		this.call('Relay.Call', { to: to, fn: method, args: args }, cbk, timeout);
+	}).bind(this);
+
 	this.onRpcTimeout = (function (seq) {
 		var call = this.pendingCalls[seq];
 		if (call != undefined) {
@@ -89,9 +150,12 @@ function BirpcSocket(url) {
 		}
 	}).bind(this);
 
-	this.call = (function (method, args, cbk, timeout) {
+	this.call = (function (method, args, cbk, timeout, meta) {
 		var call = { cbk: cbk };
 		var callmsg = { id: this.sequence, fn: method, args: args };
+		if (meta) {
+			callmsg.meta = meta;
+		}
 
 		this.ws.send(JSON.stringify(callmsg));
 		//console.log("JS<-:" + JSON.stringify(callmsg));
@@ -0,0 +1,186 @@
+// Package cbormsg is a birpc Codec that sends CBOR (RFC 8949), over
+// any io.ReadWriteCloser or as binary WebSocket messages. It is meant
+// for constrained peers that have a CBOR library but no JSON parser.
+//
+// The fields of birpc.Message are sent as small integer map keys:
+//
+//	1: id, 2: fn, 3: args, 4: result, 5: error, 6: meta, 7: ch
+//
+// and the fields of an error as 1: msg, 2: code. Args and results use
+// the cbor struct tags of their types, falling back to json tags.
+package cbormsg
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/tv42/birpc"
+)
+
+type wireError struct {
+	Msg  string `cbor:"1,keyasint,omitempty"`
+	Code int    `cbor:"2,keyasint,omitempty"`
+}
+
+// Args and Result stay encoded until UnmarshalArgs or
+// UnmarshalResult know what type to decode them into.
+type wireMessage struct {
+	ID      uint64          `cbor:"1,keyasint,omitempty"`
+	Func    string          `cbor:"2,keyasint,omitempty"`
+	Args    cbor.RawMessage `cbor:"3,keyasint,omitempty"`
+	Result  cbor.RawMessage `cbor:"4,keyasint,omitempty"`
+	Error   *wireError      `cbor:"5,keyasint,omitempty"`
+	Meta    birpc.Metadata  `cbor:"6,keyasint,omitempty"`
+	Channel string          `cbor:"7,keyasint,omitempty"`
+}
+
+type outMessage struct {
+	ID      uint64         `cbor:"1,keyasint,omitempty"`
+	Func    string         `cbor:"2,keyasint,omitempty"`
+	Args    interface{}    `cbor:"3,keyasint,omitempty"`
+	Result  interface{}    `cbor:"4,keyasint,omitempty"`
+	Error   *wireError     `cbor:"5,keyasint,omitempty"`
+	Meta    birpc.Metadata `cbor:"6,keyasint,omitempty"`
+	Channel string         `cbor:"7,keyasint,omitempty"`
+}
+
+var (
+	defaultEncMode, _       = cbor.EncOptions{}.EncMode()
+	deterministicEncMode, _ = cbor.CoreDetEncOptions().EncMode()
+	decMode, _              = cbor.DecOptions{}.DecMode()
+)
+
+// encoder holds the encoding mode shared by both codec flavors.
+type encoder struct {
+	mu   sync.Mutex
+	mode cbor.EncMode
+}
+
+// SetDeterministic selects the Core Deterministic Encoding of RFC
+// 8949 section 4.2.1, so equal messages always encode to the same
+// bytes. It is off by default, as it costs sorting map keys.
+func (e *encoder) SetDeterministic(deterministic bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if deterministic {
+		e.mode = deterministicEncMode
+	} else {
+		e.mode = defaultEncMode
+	}
+}
+
+func (e *encoder) marshal(msg *birpc.Message) ([]byte, error) {
+	e.mu.Lock()
+	mode := e.mode
+	e.mu.Unlock()
+	if mode == nil {
+		mode = defaultEncMode
+	}
+
+	out := outMessage{
+		ID:      msg.ID,
+		Func:    msg.Func,
+		Args:    msg.Args,
+		Result:  msg.Result,
+		Meta:    msg.Meta,
+		Channel: msg.Channel,
+	}
+	if msg.Error != nil {
+		out.Error = &wireError{Msg: msg.Error.Msg, Code: msg.Error.Code}
+	}
+	return mode.Marshal(out)
+}
+
+func decodeMessage(dec *cbor.Decoder, msg *birpc.Message) error {
+	var wm wireMessage
+	if err := dec.Decode(&wm); err != nil {
+		return err
+	}
+	msg.ID = wm.ID
+	msg.Func = wm.Func
+	msg.Args = wm.Args
+	msg.Result = wm.Result
+	msg.Meta = wm.Meta
+	msg.Channel = wm.Channel
+	msg.Error = nil
+	if wm.Error != nil {
+		msg.Error = &birpc.Error{Msg: wm.Error.Msg, Code: wm.Error.Code}
+	}
+	return nil
+}
+
+func unmarshalArgs(msg *birpc.Message, args interface{}) error {
+	raw := msg.Args.(cbor.RawMessage)
+	if raw == nil {
+		return nil
+	}
+	return decMode.Unmarshal(raw, args)
+}
+
+func unmarshalResult(msg *birpc.Message, result interface{}) error {
+	raw := msg.Result.(cbor.RawMessage)
+	if raw == nil {
+		return errors.New("birpc.cbormsg response must set result")
+	}
+	return decMode.Unmarshal(raw, result)
+}
+
+type codec struct {
+	encoder
+	dec     *cbor.Decoder
+	sending sync.Mutex
+	w       io.Writer
+	closer  io.Closer
+}
+
+func (c *codec) ReadMessage(msg *birpc.Message) error {
+	return decodeMessage(c.dec, msg)
+}
+
+func (c *codec) WriteMessage(msg *birpc.Message) error {
+	buf, err := c.marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	_, err = c.w.Write(buf)
+	return err
+}
+
+func (c *codec) Close() error {
+	return c.closer.Close()
+}
+
+func (c *codec) UnmarshalArgs(msg *birpc.Message, args interface{}) error {
+	return unmarshalArgs(msg, args)
+}
+
+func (c *codec) UnmarshalResult(msg *birpc.Message, result interface{}) error {
+	return unmarshalResult(msg, result)
+}
+
+func (c *codec) Ping() error {
+	return nil
+}
+
+func (c *codec) Pong() error {
+	return nil
+}
+
+func (c *codec) SetPingHandler(handler func(string) error) {}
+func (c *codec) SetPongHandler(handler func(string) error) {}
+
+// NewCodec returns a codec that sends a sequence of CBOR data items
+// over conn. CBOR data items are self-delimiting, so no further
+// framing is needed.
+func NewCodec(conn io.ReadWriteCloser) *codec {
+	c := &codec{
+		dec:    decMode.NewDecoder(conn),
+		w:      conn,
+		closer: conn,
+	}
+	return c
+}
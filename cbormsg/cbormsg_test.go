@@ -0,0 +1,167 @@
+package cbormsg_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/tv42/birpc"
+	"github.com/tv42/birpc/cbormsg"
+)
+
+type Request struct {
+	Word string `json:"word"`
+}
+
+type Reply struct {
+	Length int `cbor:"1,keyasint"`
+}
+
+type WordLength struct{}
+
+func (_ WordLength) Len(request *Request, reply *Reply) error {
+	reply.Length = len(request.Word)
+	return nil
+}
+
+func makeRegistry() *birpc.Registry {
+	r := birpc.NewRegistry()
+	r.RegisterService(WordLength{})
+	return r
+}
+
+func TestServerIntegerKeys(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	server := birpc.NewEndpoint(cbormsg.NewCodec(s), makeRegistry())
+	server_err := make(chan error)
+	go func() {
+		server_err <- server.Serve()
+	}()
+
+	go func() {
+		buf, _ := cbor.Marshal(map[int]interface{}{
+			1: 42,
+			2: "WordLength.Len",
+			3: map[string]string{"word": "saippuakauppias"},
+		})
+		c.Write(buf)
+	}()
+
+	var reply map[uint64]interface{}
+	if err := cbor.NewDecoder(c).Decode(&reply); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	t.Logf("reply msg: %#v", reply)
+	if g, e := reply[1], uint64(42); g != e {
+		t.Errorf("wrong id: %#v", g)
+	}
+	if reply[5] != nil {
+		t.Fatalf("unexpected error response: %v", reply[5])
+	}
+	result, ok := reply[4].(map[interface{}]interface{})
+	if !ok {
+		t.Fatalf("unexpected result: %#v", reply[4])
+	}
+	if g, e := result[uint64(1)], uint64(15); g != e {
+		t.Errorf("got wrong answer: %#v", g)
+	}
+
+	c.Close()
+
+	err := <-server_err
+	if err != io.EOF {
+		t.Fatalf("unexpected error from ServeCodec: %v", err)
+	}
+}
+
+// recorder captures what a codec writes.
+type recorder struct {
+	bytes.Buffer
+}
+
+func (*recorder) Close() error { return nil }
+
+func TestDeterministic(t *testing.T) {
+	msg := &birpc.Message{
+		ID:   1,
+		Func: "Sensor.Report",
+		Args: map[string]int{"z": 1, "a": 2, "m": 3, "b": 4},
+	}
+
+	var first []byte
+	for i := 0; i < 10; i++ {
+		var rec recorder
+		codec := cbormsg.NewCodec(&rec)
+		codec.SetDeterministic(true)
+		if err := codec.WriteMessage(msg); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		if first == nil {
+			first = rec.Bytes()
+			continue
+		}
+		if !bytes.Equal(rec.Bytes(), first) {
+			t.Fatalf("encoding is not deterministic: %x != %x", rec.Bytes(), first)
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	registry := makeRegistry()
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ws, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		cbormsg.NewWebSocketEndpoint(registry, ws).Serve()
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	client := cbormsg.NewWebSocketEndpoint(nil, ws)
+	go client.Serve()
+	defer ws.Close()
+
+	reply := &Reply{}
+	if err := client.Call("WordLength.Len", &Request{"hello"}, reply); err != nil {
+		t.Fatalf("unexpected error from call: %v", err)
+	}
+	if reply.Length != 5 {
+		t.Errorf("got wrong answer: %v", reply.Length)
+	}
+
+	err = client.Call("WordLength.Nope", &Request{}, reply)
+	if err == nil || err.Error() != "No such function." {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMetaAndChannel(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	go cbormsg.NewCodec(c).WriteMessage(&birpc.Message{
+		ID:      1,
+		Func:    "Admin.Status",
+		Meta:    birpc.Metadata{"trace": "abc"},
+		Channel: "admin",
+	})
+	var msg birpc.Message
+	if err := cbormsg.NewCodec(s).ReadMessage(&msg); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if msg.Meta["trace"] != "abc" || msg.Channel != "admin" {
+		t.Errorf("lost meta or channel: %+v", msg)
+	}
+}
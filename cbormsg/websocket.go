@@ -0,0 +1,105 @@
+package cbormsg
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/tv42/birpc"
+)
+
+type wsCodec struct {
+	encoder
+	WS *websocket.Conn
+	// https://godoc.org/github.com/gorilla/websocket#hdr-Concurrency
+	// As above document.Only one concurrent reader and one concurrent writer are allowed.
+	readMu  sync.Mutex
+	writeMu sync.Mutex
+}
+
+func (c *wsCodec) ReadMessage(msg *birpc.Message) error {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	_, buf, err := c.WS.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return decodeMessage(decMode.NewDecoder(bytes.NewReader(buf)), msg)
+}
+
+func (c *wsCodec) WriteMessage(msg *birpc.Message) error {
+	buf, err := c.marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.WS.WriteMessage(websocket.BinaryMessage, buf)
+}
+
+func (c *wsCodec) Ping() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return c.WS.WriteMessage(websocket.PingMessage, []byte{})
+}
+
+func (c *wsCodec) Pong() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return c.WS.WriteMessage(websocket.PongMessage, []byte{})
+}
+
+func (c *wsCodec) SetPingHandler(handler func(string) error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	c.WS.SetPingHandler(handler)
+}
+
+func (c *wsCodec) SetPongHandler(handler func(string) error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	c.WS.SetPongHandler(handler)
+}
+
+func (c *wsCodec) Close() error {
+	return c.WS.Close()
+}
+
+func (c *wsCodec) UnmarshalArgs(msg *birpc.Message, args interface{}) error {
+	return unmarshalArgs(msg, args)
+}
+
+func (c *wsCodec) UnmarshalResult(msg *birpc.Message, result interface{}) error {
+	return unmarshalResult(msg, result)
+}
+
+func (c *wsCodec) FillArgs(arglist []reflect.Value) error {
+	for i := 0; i < len(arglist); i++ {
+		switch arglist[i].Interface().(type) {
+		case *websocket.Conn:
+			arglist[i] = reflect.ValueOf(c.WS)
+		}
+	}
+	return nil
+}
+
+// NewWebSocketCodec returns a codec that sends each message as one
+// binary WebSocket message.
+func NewWebSocketCodec(ws *websocket.Conn) *wsCodec {
+	c := &wsCodec{
+		WS: ws,
+	}
+	return c
+}
+
+// NewWebSocketEndpoint is like wetsock.NewEndpoint, but speaks
+// CBOR.
+func NewWebSocketEndpoint(registry *birpc.Registry, ws *websocket.Conn) *birpc.Endpoint {
+	c := NewWebSocketCodec(ws)
+	e := birpc.NewEndpoint(c, registry)
+	return e
+}
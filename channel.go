@@ -0,0 +1,193 @@
+package birpc
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// channelQueue is how many incoming messages are buffered for each
+// channel; see route for what happens to more.
+const channelQueue = 64
+
+// ErrChannelOpen is returned by OpenChannel for a channel that is
+// already open.
+var ErrChannelOpen = errors.New("birpc: channel already open")
+
+// ErrNoChannels is returned by OpenChannel when the codec of the
+// Endpoint can't carry Message.Channel.
+var ErrNoChannels = errors.New("birpc: codec does not carry channels")
+
+// ChannelCarrier is an optional interface that a Codec may implement,
+// if its wire format has no room for Message.Channel. OpenChannel
+// fails with ErrNoChannels when CarriesChannels returns false.
+type ChannelCarrier interface {
+	CarriesChannels() bool
+}
+
+// channelCodec is the Codec of a channel Endpoint. It sends through
+// the parent Endpoint, and reads what the parent routes to it.
+type channelCodec struct {
+	parent *Endpoint
+	name   string
+	in     chan *Message
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+var (
+	_ FillArgser = (*channelCodec)(nil)
+	_ ErrorCoder = (*channelCodec)(nil)
+)
+
+// OpenChannel returns an Endpoint for the logical channel name,
+// multiplexed over the connection of e. It has its own registry and
+// pending calls, and starts with the Principal of e, as well as its
+// Logger, Exporter and Collector. The peer must open the same channel
+// to talk on it.
+//
+// Serve the returned Endpoint as usual; it stops when e does, or when
+// it is closed. A channel with too many unserved messages doesn't hold
+// up the connection: further requests on it are refused with
+// CodeRateLimited, and a response it has no room for closes it.
+// Channels need a codec that carries Message.Channel; see
+// ChannelCarrier.
+func (e *Endpoint) OpenChannel(name string, registry *Registry) (*Endpoint, error) {
+	if name == "" {
+		return nil, errors.New("birpc: channel name must not be empty")
+	}
+	if cc, ok := e.codec.(ChannelCarrier); ok && !cc.CarriesChannels() {
+		return nil, ErrNoChannels
+	}
+	c := &channelCodec{
+		parent: e,
+		name:   name,
+		in:     make(chan *Message, channelQueue),
+		closed: make(chan struct{}),
+	}
+	e.channels.Lock()
+	defer e.channels.Unlock()
+	if e.channels.m == nil {
+		e.channels.m = make(map[string]*channelCodec)
+	}
+	if _, ok := e.channels.m[name]; ok {
+		return nil, ErrChannelOpen
+	}
+	e.channels.m[name] = c
+
+	sub := NewEndpoint(c, registry)
+	sub.SetPrincipal(e.Principal())
+	sub.logger = e.logger
+	sub.exporter = e.exporter
+	sub.collector = e.getCollector()
+	return sub, nil
+}
+
+// route passes an incoming message to its channel.
+func (e *Endpoint) route(msg *Message) error {
+	e.channels.Lock()
+	c, ok := e.channels.m[msg.Channel]
+	e.channels.Unlock()
+	if !ok {
+		if msg.Func == "" {
+			e.getLogger().Warn("birpc: response on unknown channel", "channel", msg.Channel, "id", msg.ID)
+			return nil
+		}
+		return e.reject(msg, &Error{Msg: "Unknown channel.", Code: CodeMethodNotFound})
+	}
+	// never block, the other channels would wait too
+	select {
+	case c.in <- msg:
+		return nil
+	case <-c.closed:
+		// closed meanwhile
+		return nil
+	default:
+	}
+	if msg.Func == "" {
+		// the caller would wait for it forever
+		e.getLogger().Warn("birpc: channel queue full, closing", "channel", msg.Channel, "id", msg.ID)
+		c.Close()
+		return nil
+	}
+	e.getLogger().Info("birpc: channel queue full", "channel", msg.Channel, "method", msg.Func, "id", msg.ID)
+	if rc, ok := e.getCollector().(RejectCollector); ok {
+		rc.CallRejected(msg.Func)
+	}
+	return e.reject(msg, &Error{Msg: "Channel busy.", Code: CodeRateLimited})
+}
+
+// closeChannels ends all channels, when e stops serving.
+func (e *Endpoint) closeChannels() {
+	e.channels.Lock()
+	list := make([]*channelCodec, 0, len(e.channels.m))
+	for _, c := range e.channels.m {
+		list = append(list, c)
+	}
+	e.channels.Unlock()
+	for _, c := range list {
+		c.Close()
+	}
+}
+
+func (c *channelCodec) ReadMessage(msg *Message) error {
+	select {
+	case m := <-c.in:
+		*msg = *m
+		msg.Channel = ""
+		return nil
+	case <-c.closed:
+		return io.EOF
+	}
+}
+
+func (c *channelCodec) WriteMessage(msg *Message) error {
+	select {
+	case <-c.closed:
+		return io.ErrClosedPipe
+	default:
+	}
+	out := *msg
+	out.Channel = c.name
+	return c.parent.send(&out)
+}
+
+func (c *channelCodec) UnmarshalArgs(msg *Message, args interface{}) error {
+	return c.parent.codec.UnmarshalArgs(msg, args)
+}
+
+func (c *channelCodec) UnmarshalResult(msg *Message, result interface{}) error {
+	return c.parent.codec.UnmarshalResult(msg, result)
+}
+
+func (c *channelCodec) FillArgs(arglist []reflect.Value) error {
+	if filler, ok := c.parent.codec.(FillArgser); ok {
+		return filler.FillArgs(arglist)
+	}
+	return nil
+}
+
+// the parent Endpoint decides whether to send error codes
+func (c *channelCodec) CarriesErrorCodes() bool { return true }
+
+// the parent Endpoint pings the connection
+
+func (c *channelCodec) Ping() error                               { return nil }
+func (c *channelCodec) Pong() error                               { return nil }
+func (c *channelCodec) SetPingHandler(handler func(string) error) {}
+func (c *channelCodec) SetPongHandler(handler func(string) error) {}
+
+// Close closes the channel, leaving the connection open.
+func (c *channelCodec) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.parent.channels.Lock()
+		if c.parent.channels.m[c.name] == c {
+			delete(c.parent.channels.m, c.name)
+		}
+		c.parent.channels.Unlock()
+	})
+	return nil
+}
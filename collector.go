@@ -0,0 +1,70 @@
+package birpc
+
+import (
+	"time"
+)
+
+// Direction tells whether a message was received or sent.
+type Direction int
+
+const (
+	Inbound Direction = iota
+	Outbound
+)
+
+func (d Direction) String() string {
+	if d == Outbound {
+		return "out"
+	}
+	return "in"
+}
+
+// Collector receives measurements from Endpoints, see
+// Registry.SetCollector. Its methods are called concurrently, and
+// should not block. Package metrics provides an implementation.
+type Collector interface {
+	// CallStarted is called when an incoming call to a registered
+	// method starts.
+	CallStarted(method string)
+	// CallFinished is called once the response has been sent. err
+	// is nil if the call succeeded.
+	CallFinished(method string, err *Error, elapsed time.Duration)
+	// MessageSize is called for every message, if the codec
+	// implements SizeReporter.
+	MessageSize(dir Direction, size int)
+	// PingRTT is called when a pong answers our ping.
+	PingRTT(rtt time.Duration)
+}
+
+// SizeReporter is an optional interface that a Codec may implement,
+// to report the encoded size of the messages it reads and writes.
+// Serve sets the handler before reading any messages.
+type SizeReporter interface {
+	SetSizeHandler(func(dir Direction, size int))
+}
+
+// SetCollector makes every Endpoint using this Registry report to c,
+// unless the Endpoint has a Collector of its own.
+func (r *Registry) SetCollector(c Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collector = c
+}
+
+// SetCollector makes the Endpoint report to c instead of the
+// Collector of its Registry.
+//
+// Must be called before Serve.
+func (e *Endpoint) SetCollector(c Collector) {
+	e.collector = c
+}
+
+// getCollector returns the Collector to report to, or nil.
+func (e *Endpoint) getCollector() Collector {
+	if e.collector != nil {
+		return e.collector
+	}
+	e.server.registry.mu.RLock()
+	defer e.server.registry.mu.RUnlock()
+	return e.server.registry.collector
+}
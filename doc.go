@@ -7,6 +7,10 @@
 //
 //   - wetsock: JSON over WebSocket (over HTTP(S))
 //   - jsonmsg: JSON over any io.ReadWriteCloser (for example, a TCP connection)
+//   - jsonrpc2: JSON-RPC 2.0 over an io.ReadWriteCloser or a WebSocket
+//   - msgpackmsg: MessagePack over an io.ReadWriteCloser or a WebSocket
+//   - cbormsg: CBOR over an io.ReadWriteCloser or a WebSocket
+//   - protomsg: Protocol Buffers over a length-delimited stream or a WebSocket
 //
 // This package was inspired by net/rpc, but is intended for more
 // interactive applications. In particular, the wetsock transport,
@@ -19,9 +23,33 @@
 // some of the types that will be filled:
 //
 //   - *birpc.Endpoint: the Endpoint this method call was received on
+//   - *birpc.CallInfo: the name, ID and metadata of this method call
+//   - *birpc.Principal: the authenticated peer, see Endpoint.SetPrincipal
 //   - *websocket.Conn (as in github.com/gorilla/websocket): the
 //     WebSocket this method call was received on (when using wetsock)
 //
+// Methods can keep per-connection state in the Session of their
+// Endpoint; it is cleaned up when the connection goes away. To run
+// code when connections come and go, see Registry.OnConnect and
+// Registry.OnDisconnect.
+//
+// Peers may start with a handshake, exchanging protocol version and
+// features; see Endpoint.SetHello. Endpoints always answer a
+// handshake, and peers that can't are treated as legacy, so newer
+// behavior is only used when both sides announced it.
+//
+// Endpoints can report spans of every call to an Exporter (see
+// Endpoint.SetExporter), and counters and latencies to a Collector
+// (see Registry.SetCollector and package metrics).
+//
+// Several logical channels, each with its own Registry, can share one
+// connection; see Endpoint.OpenChannel.
+//
+// Servers with many peers can track them in a Hub, to notify or call
+// all of them, or named groups of them, at once. Package pubsub builds
+// topic subscriptions on top of that, and package relay lets peers
+// call each other through the server.
+//
 // The types Error, Message and FillArgser are only needed if you're
 // implementing a new Codec.
 package birpc
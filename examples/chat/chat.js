@@ -91,6 +91,11 @@ function connect() {
 
 	div.appendChild(line);
 
+	if (!rpc.id || rpc.id == "0") {
+	    // untagged, sent with Endpoint.Notify; nobody waits for
+	    // an answer
+	    return;
+	}
 	delete rpc.fn;
 	delete rpc.args;
 	rpc.result = {};
@@ -13,7 +13,6 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/tv42/birpc"
 	"github.com/tv42/birpc/wetsock"
-	"github.com/tv42/topic"
 )
 
 var (
@@ -55,8 +54,8 @@ func index(w http.ResponseWriter, req *http.Request) {
 }
 
 type Chat struct {
-	broadcast *topic.Topic
-	registry  *birpc.Registry
+	hub      *birpc.Hub
+	registry *birpc.Registry
 }
 
 type nothing struct{}
@@ -64,11 +63,11 @@ type nothing struct{}
 func (c *Chat) Message(msg *Incoming, _ *nothing, ws *websocket.Conn) error {
 	log.Printf("recv from %v:%#v\n", ws.RemoteAddr(), msg)
 
-	c.broadcast.Broadcast <- Outgoing{
+	c.hub.Broadcast("Chat.Message", Outgoing{
 		Time:    time.Now(),
 		From:    msg.From,
 		Message: msg.Message,
-	}
+	})
 	return nil
 }
 
@@ -88,10 +87,14 @@ func main() {
 	log.Printf("Serving at http://%s:%d/", *host, *port)
 
 	chat := Chat{}
-	chat.broadcast = topic.New()
+	chat.hub = birpc.NewHub()
+	// the hub kicks out clients too slow to keep up; probably a hung
+	// TCP connection. they can re-establish.
+	chat.hub.OnRemove(func(e *birpc.Endpoint) {
+		log.Printf("Client left, %d remaining", len(chat.hub.Endpoints()))
+	})
 	chat.registry = birpc.NewRegistry()
 	chat.registry.RegisterService(&chat)
-	defer close(chat.broadcast.Broadcast)
 	upgrader := websocket.Upgrader{}
 
 	serve := func(w http.ResponseWriter, req *http.Request) {
@@ -101,24 +104,7 @@ func main() {
 			return
 		}
 		endpoint := wetsock.NewEndpoint(chat.registry, ws)
-		messages := make(chan interface{}, 10)
-		chat.broadcast.Register(messages)
-		go func() {
-			defer chat.broadcast.Unregister(messages)
-			for i := range messages {
-				msg := i.(Outgoing)
-				// Fire-and-forget.
-				// TODO use .Notify when it exists
-				_ = endpoint.Go("Chat.Message", msg, nil, nil)
-			}
-			// broadcast topic kicked us out for being too slow;
-			// probably a hung TCP connection. let client
-			// re-establish.
-			log.Printf("Kicking slow client: %v", ws.RemoteAddr())
-			ws.Close()
-		}()
-
-		if err := endpoint.Serve(); err != nil {
+		if err := chat.hub.Serve(endpoint); err != nil {
 			log.Printf("websocket error from %v: %v", ws.RemoteAddr(), err)
 		}
 	}
@@ -0,0 +1,209 @@
+// Package framing splits a byte stream into length-prefixed frames,
+// so codecs can send arbitrary binary messages over an
+// io.ReadWriteCloser.
+//
+// Each frame is its length followed by that many bytes. The length is
+// either a protobuf-style unsigned varint, or a fixed 4-byte big-endian
+// integer. As the length is known up front, a frame that is too large
+// or fails to decode can be skipped without losing track of where the
+// next one starts, unless it is far over the limit; see SkipSize.
+package framing
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+// Prefix selects how frame lengths are encoded.
+type Prefix int
+
+const (
+	// Varint prefixes frames with an unsigned varint, as used by
+	// protobuf's length-delimited streams.
+	Varint Prefix = iota
+	// Fixed32 prefixes frames with a big-endian uint32.
+	Fixed32
+)
+
+func (p Prefix) String() string {
+	switch p {
+	case Varint:
+		return "varint"
+	case Fixed32:
+		return "fixed32"
+	}
+	return fmt.Sprintf("Prefix(%d)", int(p))
+}
+
+// DefaultMaxFrameSize is the frame size limit used when none is given.
+const DefaultMaxFrameSize = 16 << 20
+
+// HeadSize is how much of a frame over the size limit is kept in
+// FrameTooLargeError.Head.
+const HeadSize = 4096
+
+// SkipSize is how far over the size limit a frame may go and still be
+// skipped. Reading past a larger frame could keep the connection busy
+// for as long as the peer likes.
+const SkipSize = 1 << 20
+
+// FrameTooLargeError is returned for frames over the size limit.
+type FrameTooLargeError struct {
+	Size uint64
+	Max  int
+	// Head is the start of a frame that was read, at most HeadSize
+	// bytes, so the reader can tell what it was about.
+	Head []byte
+	// Skipped is set when reading, if the frame has been skipped
+	// and the next ReadFrame reads the following frame. Otherwise
+	// the stream is out of sync and must be closed.
+	Skipped bool
+}
+
+func (e *FrameTooLargeError) Error() string {
+	return fmt.Sprintf("framing: frame of %d bytes exceeds limit of %d", e.Size, e.Max)
+}
+
+// Reader reads frames from a stream. It is not safe for concurrent
+// use.
+type Reader struct {
+	r      *bufio.Reader
+	prefix Prefix
+	max    int
+	// set once the stream can't be read any more
+	err error
+}
+
+// NewReader returns a Reader that reads frames from r. Frames larger
+// than maxSize bytes are rejected; maxSize 0 means
+// DefaultMaxFrameSize.
+func NewReader(r io.Reader, prefix Prefix, maxSize int) *Reader {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxFrameSize
+	}
+	return &Reader{
+		r:      bufio.NewReader(r),
+		prefix: prefix,
+		max:    maxSize,
+	}
+}
+
+// SetMaxSize changes the frame size limit of r, as given to
+// NewReader. It must not be called concurrently with ReadFrame.
+func (r *Reader) SetMaxSize(maxSize int) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxFrameSize
+	}
+	r.max = maxSize
+}
+
+func (r *Reader) readLength() (uint64, error) {
+	switch r.prefix {
+	case Varint:
+		return binary.ReadUvarint(r.r)
+	case Fixed32:
+		var buf [4]byte
+		if _, err := io.ReadFull(r.r, buf[:]); err != nil {
+			return 0, err
+		}
+		return uint64(binary.BigEndian.Uint32(buf[:])), nil
+	}
+	return 0, errUnknownPrefix
+}
+
+// ReadFrame returns the next frame. It returns io.EOF only if the
+// stream ends cleanly between frames. A frame more than SkipSize
+// bytes over the limit, or one whose size doesn't fit in an int64, is
+// not skipped: ReadFrame returns a FrameTooLargeError that is not
+// Skipped, for it and every later call.
+func (r *Reader) ReadFrame() ([]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	size, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(r.max) {
+		if size > math.MaxInt64 || size-uint64(r.max) > SkipSize {
+			r.err = &FrameTooLargeError{Size: size, Max: r.max}
+			return nil, r.err
+		}
+		head := make([]byte, HeadSize)
+		if size < HeadSize {
+			head = head[:size]
+		}
+		if _, err := io.ReadFull(r.r, head); err != nil {
+			return nil, noEOF(err)
+		}
+		if _, err := io.CopyN(io.Discard, r.r, int64(size)-int64(len(head))); err != nil {
+			return nil, noEOF(err)
+		}
+		return nil, &FrameTooLargeError{Size: size, Max: r.max, Head: head, Skipped: true}
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return nil, noEOF(err)
+	}
+	return buf, nil
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Writer writes frames to a stream. It is safe for concurrent use;
+// each frame is written with a single Write call.
+type Writer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix Prefix
+	max    int
+}
+
+// NewWriter returns a Writer that writes frames to w. Frames larger
+// than maxSize bytes are refused; maxSize 0 means DefaultMaxFrameSize.
+func NewWriter(w io.Writer, prefix Prefix, maxSize int) *Writer {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxFrameSize
+	}
+	return &Writer{
+		w:      w,
+		prefix: prefix,
+		max:    maxSize,
+	}
+}
+
+var errUnknownPrefix = errors.New("framing: unknown prefix")
+
+// WriteFrame writes p as one frame.
+func (w *Writer) WriteFrame(p []byte) error {
+	if len(p) > w.max {
+		return &FrameTooLargeError{Size: uint64(len(p)), Max: w.max}
+	}
+	var buf []byte
+	switch w.prefix {
+	case Varint:
+		buf = make([]byte, 0, binary.MaxVarintLen64+len(p))
+		buf = binary.AppendUvarint(buf, uint64(len(p)))
+	case Fixed32:
+		buf = make([]byte, 4, 4+len(p))
+		binary.BigEndian.PutUint32(buf, uint32(len(p)))
+	default:
+		return errUnknownPrefix
+	}
+	buf = append(buf, p...)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.w.Write(buf)
+	return err
+}
@@ -0,0 +1,114 @@
+package framing_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/tv42/birpc/framing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for _, prefix := range []framing.Prefix{framing.Varint, framing.Fixed32} {
+		var buf bytes.Buffer
+		w := framing.NewWriter(&buf, prefix, 0)
+		frames := [][]byte{
+			[]byte("hello"),
+			{},
+			bytes.Repeat([]byte{0, 1, 2}, 1000),
+		}
+		for _, f := range frames {
+			if err := w.WriteFrame(f); err != nil {
+				t.Fatalf("%v: write failed: %v", prefix, err)
+			}
+		}
+
+		r := framing.NewReader(&buf, prefix, 0)
+		for i, f := range frames {
+			got, err := r.ReadFrame()
+			if err != nil {
+				t.Fatalf("%v: read %d failed: %v", prefix, i, err)
+			}
+			if !bytes.Equal(got, f) {
+				t.Errorf("%v: frame %d mangled: %q", prefix, i, got)
+			}
+		}
+		if _, err := r.ReadFrame(); err != io.EOF {
+			t.Errorf("%v: expected EOF, got %v", prefix, err)
+		}
+	}
+}
+
+func TestFixed32Layout(t *testing.T) {
+	var buf bytes.Buffer
+	framing.NewWriter(&buf, framing.Fixed32, 0).WriteFrame([]byte("abc"))
+	if g, e := buf.String(), "\x00\x00\x00\x03abc"; g != e {
+		t.Errorf("wrong bytes: %q != %q", g, e)
+	}
+}
+
+func TestTooLargeSkipped(t *testing.T) {
+	var buf bytes.Buffer
+	w := framing.NewWriter(&buf, framing.Varint, 0)
+	w.WriteFrame(bytes.Repeat([]byte("x"), 100))
+	w.WriteFrame([]byte("small"))
+
+	r := framing.NewReader(&buf, framing.Varint, 10)
+	_, err := r.ReadFrame()
+	var tooLarge *framing.FrameTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("expected FrameTooLargeError, got %v", err)
+	}
+	if tooLarge.Size != 100 || tooLarge.Max != 10 || !tooLarge.Skipped {
+		t.Errorf("wrong error details: %#v", tooLarge)
+	}
+	if !bytes.Equal(tooLarge.Head, bytes.Repeat([]byte("x"), 100)) {
+		t.Errorf("wrong head: %q", tooLarge.Head)
+	}
+	got, err := r.ReadFrame()
+	if err != nil {
+		t.Fatalf("read after skip failed: %v", err)
+	}
+	if string(got) != "small" {
+		t.Errorf("lost sync: %q", got)
+	}
+}
+
+func TestWriteTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	err := framing.NewWriter(&buf, framing.Fixed32, 4).WriteFrame([]byte("12345"))
+	var tooLarge *framing.FrameTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("expected FrameTooLargeError, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("wrote a partial frame: %q", buf.Bytes())
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	r := framing.NewReader(bytes.NewReader([]byte("\x00\x00\x00\x05ab")), framing.Fixed32, 0)
+	if _, err := r.ReadFrame(); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestTooLargeNotSkipped(t *testing.T) {
+	for _, size := range []uint64{10 + framing.SkipSize + 1, math.MaxUint64} {
+		var buf bytes.Buffer
+		buf.Write(binary.AppendUvarint(nil, size))
+
+		r := framing.NewReader(&buf, framing.Varint, 10)
+		for i := 0; i < 2; i++ {
+			// the stream stays unusable
+			_, err := r.ReadFrame()
+			var tooLarge *framing.FrameTooLargeError
+			if !errors.As(err, &tooLarge) || tooLarge.Skipped || tooLarge.Size != size {
+				t.Fatalf("expected a FrameTooLargeError not skipped, got %#v", err)
+			}
+		}
+	}
+}
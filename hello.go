@@ -0,0 +1,191 @@
+package birpc
+
+import (
+	"sync"
+	"time"
+)
+
+// ProtocolVersion is the version of the birpc protocol spoken by
+// this package. Peers that never send a hello are assumed to speak
+// version 0, the protocol of the original birpc.js.
+const ProtocolVersion = 1
+
+// Features this package knows about. A feature is only used on a
+// connection once both peers have announced it.
+const (
+	// FeatureErrorCodes means Error.Code is understood.
+	FeatureErrorCodes = "error-codes"
+	// FeatureBatch means batches of messages can be read, see
+	// Endpoint.SetBatchWindow.
+	FeatureBatch = "batch"
+)
+
+// HelloMethod is the name of the built-in function used for the
+// handshake. It is answered by every Endpoint, whether or not it
+// sends a hello itself.
+const HelloMethod = "birpc.hello"
+
+var (
+	handshakeTimeout = 10 * time.Second
+)
+
+// Hello is exchanged by peers at the start of a connection, see
+// Endpoint.SetHello.
+type Hello struct {
+	Version  int               `json:"version"`
+	Features []string          `json:"features,omitempty"`
+	Options  map[string]string `json:"options,omitempty"`
+}
+
+// DefaultHello returns the hello describing this package: the current
+// protocol version and every feature it supports.
+func DefaultHello() *Hello {
+	return &Hello{
+		Version:  ProtocolVersion,
+		Features: []string{FeatureErrorCodes, FeatureBatch},
+	}
+}
+
+// Capabilities is the outcome of the handshake.
+type Capabilities struct {
+	// Version is the protocol version both peers speak, 0 for a
+	// legacy peer.
+	Version int
+	// Features supported by both peers.
+	Features map[string]bool
+	// Options the peer sent in its hello.
+	Options map[string]string
+}
+
+// Has reports whether both peers support feature.
+func (c Capabilities) Has(feature string) bool {
+	return c.Features[feature]
+}
+
+func negotiate(local, peer *Hello) Capabilities {
+	c := Capabilities{
+		Version:  local.Version,
+		Features: make(map[string]bool),
+		Options:  peer.Options,
+	}
+	if peer.Version < c.Version {
+		c.Version = peer.Version
+	}
+	offered := make(map[string]bool, len(peer.Features))
+	for _, f := range peer.Features {
+		offered[f] = true
+	}
+	for _, f := range local.Features {
+		if offered[f] {
+			c.Features[f] = true
+		}
+	}
+	return c
+}
+
+// handshake holds the handshake state of an Endpoint.
+type handshake struct {
+	// hello is sent at the start of Serve if set.
+	hello *Hello
+
+	mu   sync.Mutex
+	caps *Capabilities
+	done chan struct{}
+	once sync.Once
+}
+
+// SetHello makes Serve start with a handshake, sending hello to the
+// peer. Use DefaultHello unless you need to restrict the features or
+// pass options. Peers that don't know the handshake are treated as
+// legacy, see Capabilities.
+//
+// Must be called before Serve.
+func (e *Endpoint) SetHello(hello *Hello) {
+	e.handshake.hello = hello
+}
+
+// localHello is what we send or answer the peer with. Features the
+// codec can't support are left out.
+func (e *Endpoint) localHello() *Hello {
+	hello := e.handshake.hello
+	if hello == nil {
+		hello = DefaultHello()
+	}
+	if _, ok := e.codec.(BatchWriter); ok {
+		return hello
+	}
+	trimmed := *hello
+	trimmed.Features = nil
+	for _, f := range hello.Features {
+		if f != FeatureBatch {
+			trimmed.Features = append(trimmed.Features, f)
+		}
+	}
+	return &trimmed
+}
+
+func (e *Endpoint) setCapabilities(c Capabilities) {
+	e.handshake.mu.Lock()
+	e.handshake.caps = &c
+	e.handshake.mu.Unlock()
+	e.endHandshake()
+}
+
+// endHandshake closes HandshakeDone, if it is not closed yet.
+func (e *Endpoint) endHandshake() {
+	e.handshake.once.Do(func() { close(e.handshake.done) })
+}
+
+// Capabilities returns the result of the handshake. Until a handshake
+// has completed, the peer is assumed to be legacy and the result has
+// version 0 and no features.
+func (e *Endpoint) Capabilities() Capabilities {
+	e.handshake.mu.Lock()
+	defer e.handshake.mu.Unlock()
+	if e.handshake.caps == nil {
+		return Capabilities{}
+	}
+	return *e.handshake.caps
+}
+
+// HandshakeDone returns a channel that is closed once Capabilities
+// are known: the peer answered our hello, failed to, or sent its own.
+// Without SetHello, the first message from the peer that is not a
+// hello closes it too, as peers send their hello first; a hello that
+// comes later still updates Capabilities. It is closed when Serve
+// returns, at the latest.
+func (e *Endpoint) HandshakeDone() <-chan struct{} {
+	return e.handshake.done
+}
+
+// sendHello runs the handshake from our side.
+func (e *Endpoint) sendHello() {
+	local := e.localHello()
+	var peer Hello
+	err := e.CallWithDeadline(HelloMethod, local, &peer, time.Now().Add(handshakeTimeout))
+	if err != nil {
+		// legacy peer, or one that never answered
+		e.getLogger().Debug("birpc: peer is legacy", "err", err)
+		peer = Hello{}
+	}
+	e.setCapabilities(negotiate(local, &peer))
+}
+
+// serveHello answers a hello from the peer.
+func (e *Endpoint) serveHello(msg *Message) error {
+	var peer Hello
+	if err := e.codec.UnmarshalArgs(msg, &peer); err != nil {
+		msg.Error = &Error{Msg: err.Error(), Code: CodeInvalidParams}
+		msg.Func = ""
+		msg.Args = nil
+		msg.Result = nil
+		return e.send(msg)
+	}
+	local := e.localHello()
+	e.setCapabilities(negotiate(local, &peer))
+	msg.Error = nil
+	msg.Func = ""
+	msg.Args = nil
+	msg.Result = local
+	return e.send(msg)
+}
@@ -0,0 +1,291 @@
+package birpc
+
+import (
+	"context"
+	"sync"
+)
+
+// SlowPolicy says what a Hub does with an Endpoint that can't keep up
+// with its notifications.
+type SlowPolicy int
+
+const (
+	// DisconnectSlow closes the connection, letting the peer
+	// reconnect and catch up. A hung TCP connection is the usual
+	// cause.
+	DisconnectSlow SlowPolicy = iota
+	// DropSlow drops the notifications that don't fit in the queue.
+	DropSlow
+)
+
+// DefaultHubQueue is how many notifications a Hub queues for each
+// Endpoint by default.
+const DefaultHubQueue = 64
+
+// Hub tracks live Endpoints, so they can be notified or called all at
+// once, or by named group.
+//
+// Notifications to each Endpoint are queued and written in order by a
+// goroutine of its own, so one slow peer does not hold up the others.
+// The peer serves each one in a goroutine of its own, though, so it
+// may handle them in any order.
+type Hub struct {
+	mu        sync.Mutex
+	members   map[*Endpoint]*hubMember
+	groups    map[string]map[*Endpoint]struct{}
+	queueSize int
+	policy    SlowPolicy
+	onRemove  func(*Endpoint)
+}
+
+type hubMember struct {
+	queue  chan notification
+	done   chan struct{}
+	groups map[string]struct{}
+}
+
+type notification struct {
+	function string
+	args     interface{}
+}
+
+// NewHub returns an empty Hub.
+func NewHub() *Hub {
+	return &Hub{
+		members:   make(map[*Endpoint]*hubMember),
+		groups:    make(map[string]map[*Endpoint]struct{}),
+		queueSize: DefaultHubQueue,
+	}
+}
+
+// SetQueueSize sets how many notifications are queued for each
+// Endpoint, before the SlowPolicy applies. It affects Endpoints added
+// after the call.
+func (h *Hub) SetQueueSize(n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.queueSize = n
+}
+
+// SetSlowPolicy sets what to do with Endpoints whose queue is full.
+// The default is DisconnectSlow.
+func (h *Hub) SetSlowPolicy(p SlowPolicy) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.policy = p
+}
+
+// OnRemove sets a function called with every Endpoint leaving the
+// Hub, for example to clean up state kept about it.
+func (h *Hub) OnRemove(fn func(*Endpoint)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onRemove = fn
+}
+
+// Serve adds e to the Hub, serves it, and removes it when Serve
+// returns. See Endpoint.Serve.
+func (h *Hub) Serve(e *Endpoint) error {
+	h.Add(e)
+	defer h.Remove(e)
+	return e.Serve()
+}
+
+// Add adds e to the Hub. Adding it again does nothing.
+func (h *Hub) Add(e *Endpoint) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.members[e]; ok {
+		return
+	}
+	m := &hubMember{
+		queue:  make(chan notification, h.queueSize),
+		done:   make(chan struct{}),
+		groups: make(map[string]struct{}),
+	}
+	h.members[e] = m
+	go h.send(e, m)
+}
+
+// send delivers the queued notifications to member m, until it is
+// removed. An Endpoint that fails to take one is removed from the
+// Hub.
+func (h *Hub) send(e *Endpoint, m *hubMember) {
+	for {
+		select {
+		case <-m.done:
+			return
+		case n := <-m.queue:
+			if err := e.Notify(n.function, n.args); err != nil {
+				e.getLogger().Warn("birpc: hub notification failed", "method", n.function, "err", err)
+				h.remove(e, m)
+				return
+			}
+		}
+	}
+}
+
+// Remove removes e from the Hub, and from all its groups.
+func (h *Hub) Remove(e *Endpoint) {
+	h.remove(e, nil)
+}
+
+// remove removes e, if its member is only, or only is nil.
+func (h *Hub) remove(e *Endpoint, only *hubMember) {
+	h.mu.Lock()
+	m, ok := h.members[e]
+	if ok && only != nil && m != only {
+		// removed and added again meanwhile
+		ok = false
+	}
+	if ok {
+		delete(h.members, e)
+		for group := range m.groups {
+			h.leave(e, group)
+		}
+		close(m.done)
+	}
+	onRemove := h.onRemove
+	h.mu.Unlock()
+
+	if ok && onRemove != nil {
+		onRemove(e)
+	}
+}
+
+// Join adds e to the named group. Endpoints that are not in the Hub
+// are ignored.
+func (h *Hub) Join(e *Endpoint, group string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	m, ok := h.members[e]
+	if !ok {
+		return
+	}
+	m.groups[group] = struct{}{}
+	g := h.groups[group]
+	if g == nil {
+		g = make(map[*Endpoint]struct{})
+		h.groups[group] = g
+	}
+	g[e] = struct{}{}
+}
+
+// Leave removes e from the named group.
+func (h *Hub) Leave(e *Endpoint, group string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.leave(e, group)
+}
+
+// leave removes e from group; h.mu must be held.
+func (h *Hub) leave(e *Endpoint, group string) {
+	if m, ok := h.members[e]; ok {
+		delete(m.groups, group)
+	}
+	g := h.groups[group]
+	delete(g, e)
+	if len(g) == 0 {
+		delete(h.groups, group)
+	}
+}
+
+// Endpoints returns the Endpoints in the Hub.
+func (h *Hub) Endpoints() []*Endpoint {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := make([]*Endpoint, 0, len(h.members))
+	for e := range h.members {
+		list = append(list, e)
+	}
+	return list
+}
+
+// Group returns the Endpoints in the named group.
+func (h *Hub) Group(group string) []*Endpoint {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	g := h.groups[group]
+	list := make([]*Endpoint, 0, len(g))
+	for e := range g {
+		list = append(list, e)
+	}
+	return list
+}
+
+// Broadcast notifies every Endpoint in the Hub. See Endpoint.Notify.
+func (h *Hub) Broadcast(function string, args interface{}) {
+	h.notify(h.Endpoints(), function, args)
+}
+
+// BroadcastGroup notifies every Endpoint in the named group.
+func (h *Hub) BroadcastGroup(group string, function string, args interface{}) {
+	h.notify(h.Group(group), function, args)
+}
+
+// Send notifies one Endpoint, through its queue. Endpoints that are
+// not in the Hub are ignored.
+func (h *Hub) Send(e *Endpoint, function string, args interface{}) {
+	h.notify([]*Endpoint{e}, function, args)
+}
+
+func (h *Hub) notify(list []*Endpoint, function string, args interface{}) {
+	n := notification{function: function, args: args}
+	for _, e := range list {
+		h.mu.Lock()
+		m, ok := h.members[e]
+		policy := h.policy
+		h.mu.Unlock()
+		if !ok {
+			// removed meanwhile
+			continue
+		}
+		select {
+		case m.queue <- n:
+		case <-m.done:
+		default:
+			if policy == DisconnectSlow {
+				e.getLogger().Warn("birpc: hub disconnecting slow endpoint", "method", function)
+				e.codec.Close()
+				h.Remove(e)
+			} else {
+				e.getLogger().Debug("birpc: hub dropping notification", "method", function)
+			}
+		}
+	}
+}
+
+// HubReply is the outcome of calling one Endpoint of a Hub.
+type HubReply struct {
+	Endpoint *Endpoint
+	Reply    interface{}
+	Err      error
+}
+
+// CallAll calls function on every Endpoint in the Hub concurrently,
+// and waits for all of them, or for ctx to be done. newReply returns
+// where to store each reply.
+func (h *Hub) CallAll(ctx context.Context, function string, args interface{}, newReply func() interface{}) []HubReply {
+	return h.call(ctx, h.Endpoints(), function, args, newReply)
+}
+
+// CallGroup is like CallAll, for the Endpoints in the named group.
+func (h *Hub) CallGroup(ctx context.Context, group string, function string, args interface{}, newReply func() interface{}) []HubReply {
+	return h.call(ctx, h.Group(group), function, args, newReply)
+}
+
+func (h *Hub) call(ctx context.Context, list []*Endpoint, function string, args interface{}, newReply func() interface{}) []HubReply {
+	replies := make([]HubReply, len(list))
+	var wg sync.WaitGroup
+	for i, e := range list {
+		replies[i].Endpoint = e
+		replies[i].Reply = newReply()
+		wg.Add(1)
+		go func(r *HubReply) {
+			defer wg.Done()
+			r.Err = r.Endpoint.CallContext(ctx, function, args, r.Reply)
+		}(&replies[i])
+	}
+	wg.Wait()
+	return replies
+}
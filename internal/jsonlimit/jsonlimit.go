@@ -0,0 +1,173 @@
+// Package jsonlimit helps JSON codecs enforce limits on messages.
+package jsonlimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+
+	"github.com/tv42/birpc"
+)
+
+// Depth returns how deeply the JSON in buf nests arrays and objects.
+// buf need not be complete.
+func Depth(buf []byte) int {
+	depth, max := 0, 0
+	inString, escaped := false, false
+	for _, c := range buf {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{' || c == '[':
+			depth++
+			if depth > max {
+				max = depth
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return max
+}
+
+// Peek finds the "id" and "fn" of the message in buf, which may be
+// truncated. Anything it can't find is left zero.
+func Peek(buf []byte) (id uint64, fn string) {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return 0, ""
+	}
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return id, fn
+		}
+		key, ok := t.(string)
+		if !ok {
+			// end of object
+			return id, fn
+		}
+		switch key {
+		case "id", "fn":
+			t, err := dec.Token()
+			if err != nil {
+				return id, fn
+			}
+			switch v := t.(type) {
+			case string:
+				if key == "fn" {
+					fn = v
+				} else {
+					id, _ = strconv.ParseUint(v, 10, 64)
+				}
+			case json.Number:
+				if key == "id" {
+					id, _ = strconv.ParseUint(v.String(), 10, 64)
+				}
+			}
+		default:
+			if err := skip(dec); err != nil {
+				return id, fn
+			}
+		}
+	}
+}
+
+// skip skips one value.
+func skip(dec *json.Decoder) error {
+	depth := 0
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// TooLarge returns the error for a message over maxSize bytes, of
+// which buf is the start.
+func TooLarge(buf []byte, maxSize int64) error {
+	id, fn := Peek(buf)
+	if id == 0 || fn == "" {
+		return &birpc.MessageTooLargeError{Max: maxSize}
+	}
+	return &birpc.RequestError{
+		ID:   id,
+		Func: fn,
+		Err:  &birpc.Error{Msg: "Message too large.", Code: birpc.CodeInvalidRequest},
+	}
+}
+
+// Invalid returns the error for buf, a message that failed to decode
+// with err. The request is answered if its id and function can be
+// found; otherwise err ends the connection.
+func Invalid(buf []byte, err error) error {
+	id, fn := Peek(buf)
+	if id == 0 || fn == "" {
+		return err
+	}
+	return &birpc.RequestError{
+		ID:   id,
+		Func: fn,
+		Err:  &birpc.Error{Msg: "Invalid message.", Code: birpc.CodeParseError},
+	}
+}
+
+// TooDeep returns the error for the message in buf, if its arguments
+// nest deeper than maxDepth. buf must be a complete message; check
+// each message of a batch on its own, see Unpack.
+func TooDeep(buf []byte, maxDepth int) error {
+	if maxDepth <= 0 {
+		return nil
+	}
+	// don't count the message itself
+	if Depth(buf)-1 <= maxDepth {
+		return nil
+	}
+	id, fn := Peek(buf)
+	if id == 0 || fn == "" {
+		return &birpc.MessageTooDeepError{Max: maxDepth}
+	}
+	return &birpc.RequestError{
+		ID:   id,
+		Func: fn,
+		Err:  &birpc.Error{Msg: "Message nested too deeply.", Code: birpc.CodeInvalidRequest},
+	}
+}
+
+// Unpack splits buf into its messages: buf itself, or the elements of
+// a batch sent as a JSON array. Each message is checked with TooDeep;
+// errs holds the error for each message, or nil. A lone message that
+// is too deep is returned as err instead.
+func Unpack(buf []byte, maxDepth int) (msgs []json.RawMessage, errs []error, err error) {
+	buf = bytes.TrimLeft(buf, " \t\r\n")
+	if len(buf) == 0 || buf[0] != '[' {
+		if err := TooDeep(buf, maxDepth); err != nil {
+			return nil, nil, err
+		}
+		return []json.RawMessage{buf}, []error{nil}, nil
+	}
+	if err := json.Unmarshal(buf, &msgs); err != nil {
+		return nil, nil, err
+	}
+	errs = make([]error, len(msgs))
+	for i, msg := range msgs {
+		errs[i] = TooDeep(msg, maxDepth)
+	}
+	return msgs, errs, nil
+}
@@ -0,0 +1,37 @@
+package jsonmsg
+
+import (
+	"encoding/json"
+
+	"github.com/tv42/birpc"
+	"github.com/tv42/birpc/internal/jsonlimit"
+)
+
+// unpack decodes a message, or a batch of messages sent as a JSON
+// array. Messages of a batch nested deeper than maxDepth are kept as
+// their error, so the others can still be served.
+func unpack(raw []byte, maxDepth int) ([]jsonMessage, error) {
+	msgs, errs, err := jsonlimit.Unpack(raw, maxDepth)
+	if err != nil {
+		return nil, err
+	}
+	batch := make([]jsonMessage, len(msgs))
+	for i, msg := range msgs {
+		if errs[i] != nil {
+			batch[i].err = errs[i]
+			continue
+		}
+		if err := json.Unmarshal(msg, &batch[i]); err != nil {
+			return nil, err
+		}
+	}
+	return batch, nil
+}
+
+func newOutBatch(msgs []*birpc.Message) []*outMessage {
+	batch := make([]*outMessage, len(msgs))
+	for i, msg := range msgs {
+		batch[i] = newOutMessage(msg)
+	}
+	return batch
+}
@@ -0,0 +1,231 @@
+package jsonmsg
+
+import (
+	"compress/flate"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/tv42/birpc"
+	"github.com/tv42/birpc/internal/jsonlimit"
+)
+
+// Control messages of the compressed mode. They are untagged
+// requests, so a plain peer answers them with an error that carries
+// no ID, which the compressed codec drops.
+const (
+	// "I can read compressed data."
+	compressOffer = "birpc.deflate"
+	// "Everything I send after this message is compressed."
+	compressStart = "birpc.deflate.start"
+)
+
+type compressCodec struct {
+	conn io.ReadWriteCloser
+
+	// only used by ReadMessage; limit reads the inflated stream once
+	// the peer compresses, so the limits bound what is decoded
+	dec      *json.Decoder
+	limit    budgetReader
+	maxDepth int
+	err      error
+	offered  bool
+
+	// timeouts are set under sending; only reads use timed.conn
+	timed timedReader
+
+	sending sync.Mutex
+	enc     *json.Encoder
+	fw      *flate.Writer
+	level   int
+}
+
+func (c *compressCodec) ReadMessage(msg *birpc.Message) error {
+	if c.err != nil {
+		return c.err
+	}
+	if !c.offered {
+		// only now, so the settings made before Serve apply
+		c.offered = true
+		go c.offer()
+	}
+	for {
+		var raw json.RawMessage
+		c.limit.reset()
+		c.timed.reset()
+		err := c.dec.Decode(&raw)
+		if _, ok := err.(errOverBudget); ok {
+			return c.tooLarge()
+		}
+		if err != nil {
+			return err
+		}
+		if err := jsonlimit.TooDeep(raw, c.maxDepth); err != nil {
+			return err
+		}
+		var jm jsonMessage
+		if err := json.Unmarshal(raw, &jm); err != nil {
+			return err
+		}
+		switch {
+		case jm.ID == 0 && jm.Func == compressOffer:
+			// don't block reading on a peer that isn't
+			// reading either
+			go c.startDeflate()
+			continue
+		case jm.ID == 0 && jm.Func == compressStart:
+			// the rest of the stream, including whatever the
+			// decoder already read ahead, is compressed
+			r := io.MultiReader(c.dec.Buffered(), &c.timed)
+			c.limit.r = flate.NewReader(r)
+			c.dec = json.NewDecoder(&c.limit)
+			continue
+		case jm.ID == 0 && jm.Func == "":
+			// a plain peer refusing our offer; responses
+			// always have IDs otherwise
+			continue
+		}
+		jm.toMessage(msg)
+		return nil
+	}
+}
+
+// SetLimits bounds incoming messages to maxSize bytes, and their
+// arguments to maxDepth levels of nested arrays and objects, like
+// SetLimits of NewCodec. Compressed messages are measured after
+// decompression. Must be called before Serve.
+func (c *compressCodec) SetLimits(maxSize int64, maxDepth int) {
+	c.limit.max = maxSize
+	c.maxDepth = maxDepth
+}
+
+// tooLarge is like that of codec.
+func (c *compressCodec) tooLarge() error {
+	c.err = &birpc.MessageTooLargeError{Max: c.limit.max}
+	return jsonlimit.TooLarge(c.limit.read, c.limit.max)
+}
+
+func (c *compressCodec) offer() {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	// errors will resurface on the next write
+	c.setWriteDeadline()
+	if err := c.enc.Encode(outMessage{Func: compressOffer}); err != nil {
+		return
+	}
+	if c.fw != nil {
+		// the peer's offer was faster than ours
+		_ = c.fw.Flush()
+	}
+}
+
+func (c *compressCodec) startDeflate() {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	if c.fw != nil {
+		return
+	}
+	// no trailing newline: the compressed stream starts right
+	// after the closing brace
+	buf, err := json.Marshal(outMessage{Func: compressStart})
+	if err != nil {
+		return
+	}
+	c.setWriteDeadline()
+	if _, err := c.conn.Write(buf); err != nil {
+		return
+	}
+	fw, err := flate.NewWriter(c.conn, c.level)
+	if err != nil {
+		return
+	}
+	c.fw = fw
+	c.enc = json.NewEncoder(fw)
+}
+
+func (c *compressCodec) WriteMessage(msg *birpc.Message) error {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	c.setWriteDeadline()
+	if err := c.enc.Encode(newOutMessage(msg)); err != nil {
+		return c.timed.timeouts.Check(err, "write")
+	}
+	if c.fw != nil {
+		// the peer must be able to decode the message now
+		return c.timed.timeouts.Check(c.fw.Flush(), "write")
+	}
+	return nil
+}
+
+// SetTimeouts is like SetTimeouts of NewCodec. Must be called before
+// Serve.
+func (c *compressCodec) SetTimeouts(t birpc.Timeouts) error {
+	conn, ok := c.conn.(deadliner)
+	if !ok {
+		return errNoDeadlines
+	}
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	if t.Idle != 0 || t.Read != 0 {
+		c.timed.conn = conn
+	}
+	c.timed.timeouts = t
+	return nil
+}
+
+// setWriteDeadline starts a write; c.sending must be held.
+func (c *compressCodec) setWriteDeadline() {
+	if c.timed.timeouts.Write == 0 {
+		return
+	}
+	if conn, ok := c.conn.(deadliner); ok {
+		conn.SetWriteDeadline(c.timed.timeouts.Deadline(c.timed.timeouts.Write))
+	}
+}
+
+func (c *compressCodec) Close() error {
+	return c.conn.Close()
+}
+
+func (c *compressCodec) UnmarshalArgs(msg *birpc.Message, args interface{}) error {
+	return unmarshalArgs(msg, args)
+}
+
+func (c *compressCodec) UnmarshalResult(msg *birpc.Message, result interface{}) error {
+	return unmarshalResult(msg, result)
+}
+
+func (c *compressCodec) Ping() error {
+	return nil
+}
+
+func (c *compressCodec) Pong() error {
+	return nil
+}
+
+func (c *compressCodec) SetPingHandler(handler func(string) error) {}
+func (c *compressCodec) SetPongHandler(handler func(string) error) {}
+
+// NewCompressedCodec returns a codec like NewCodec, that compresses
+// what it sends with DEFLATE (RFC 1951) if the peer can decompress
+// it. level is a compress/flate level.
+//
+// The codec starts out sending plain JSON, and offers to receive
+// compressed data once it starts reading. When the peer makes the
+// same offer, the codec switches to compressing. Peers using NewCodec
+// ignore the offer, and the two sides keep talking plain JSON.
+func NewCompressedCodec(conn io.ReadWriteCloser, level int) *compressCodec {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		level = flate.DefaultCompression
+	}
+	c := &compressCodec{
+		conn:  conn,
+		enc:   json.NewEncoder(conn),
+		level: level,
+	}
+	c.timed.r = conn
+	c.limit.r = &c.timed
+	c.limit.budget = -1
+	c.dec = json.NewDecoder(&c.limit)
+	return c
+}
@@ -0,0 +1,185 @@
+package jsonmsg
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/tv42/birpc"
+	"github.com/tv42/birpc/framing"
+	"github.com/tv42/birpc/internal/jsonlimit"
+)
+
+type framedCodec struct {
+	r      *framing.Reader
+	w      *framing.Writer
+	closer io.Closer
+
+	// rest of a batch, only used by ReadMessage
+	queue []jsonMessage
+	// only used by ReadMessage
+	maxDepth int
+
+	// timeouts are set before Serve; only reads use timed.conn
+	timed timedReader
+
+	mu          sync.Mutex
+	sizeHandler func(birpc.Direction, int)
+}
+
+func (c *framedCodec) ReadMessage(msg *birpc.Message) error {
+	for len(c.queue) == 0 {
+		c.timed.reset()
+		buf, err := c.r.ReadFrame()
+		var tooLarge *framing.FrameTooLargeError
+		if errors.As(err, &tooLarge) {
+			if !tooLarge.Skipped {
+				return &birpc.MessageTooLargeError{Max: int64(tooLarge.Max)}
+			}
+			// the stream is still in sync
+			return jsonlimit.TooLarge(tooLarge.Head, int64(tooLarge.Max))
+		}
+		if err != nil {
+			return err
+		}
+		batch, err := unpack(buf, c.maxDepth)
+		if err != nil {
+			// unlike with a bare json.Decoder, the next
+			// frame is still readable
+			return jsonlimit.Invalid(buf, err)
+		}
+		if handler := c.getSizeHandler(); handler != nil {
+			handler(birpc.Inbound, len(buf))
+		}
+		c.queue = batch
+	}
+	jm := c.queue[0]
+	c.queue = c.queue[1:]
+	if jm.err != nil {
+		return jm.err
+	}
+	jm.toMessage(msg)
+	return nil
+}
+
+// SetLimits bounds incoming messages to maxSize bytes, and their
+// arguments to maxDepth levels of nested arrays and objects. A zero
+// maxSize keeps the limit given to NewFramedCodec; a zero maxDepth
+// means no limit. Messages over a limit are handled like frames over
+// the size limit, see NewFramedCodec; the requests of a batch are
+// checked one by one. Must be called before Serve.
+func (c *framedCodec) SetLimits(maxSize int64, maxDepth int) {
+	if maxSize > 0 {
+		if maxSize > math.MaxInt32 {
+			maxSize = math.MaxInt32
+		}
+		c.r.SetMaxSize(int(maxSize))
+	}
+	c.maxDepth = maxDepth
+}
+
+func (c *framedCodec) WriteMessage(msg *birpc.Message) error {
+	return c.writeFrame(newOutMessage(msg))
+}
+
+// WriteBatch implements birpc.BatchWriter, sending the messages as
+// one JSON array in a single frame.
+func (c *framedCodec) WriteBatch(msgs []*birpc.Message) error {
+	return c.writeFrame(newOutBatch(msgs))
+}
+
+func (c *framedCodec) writeFrame(v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.setWriteDeadline()
+	if err := c.w.WriteFrame(buf); err != nil {
+		return c.timed.timeouts.Check(err, "write")
+	}
+	if handler := c.getSizeHandler(); handler != nil {
+		handler(birpc.Outbound, len(buf))
+	}
+	return nil
+}
+
+// SetTimeouts is like SetTimeouts of NewCodec. Must be called before
+// Serve.
+func (c *framedCodec) SetTimeouts(t birpc.Timeouts) error {
+	conn, ok := c.closer.(deadliner)
+	if !ok {
+		return errNoDeadlines
+	}
+	if t.Idle != 0 || t.Read != 0 {
+		c.timed.conn = conn
+	}
+	c.timed.timeouts = t
+	return nil
+}
+
+// setWriteDeadline starts a write.
+func (c *framedCodec) setWriteDeadline() {
+	if c.timed.timeouts.Write == 0 {
+		return
+	}
+	if conn, ok := c.closer.(deadliner); ok {
+		conn.SetWriteDeadline(c.timed.timeouts.Deadline(c.timed.timeouts.Write))
+	}
+}
+
+// SetSizeHandler implements birpc.SizeReporter. Sizes exclude the
+// length prefix.
+func (c *framedCodec) SetSizeHandler(handler func(birpc.Direction, int)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sizeHandler = handler
+}
+
+func (c *framedCodec) getSizeHandler() func(birpc.Direction, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sizeHandler
+}
+
+func (c *framedCodec) Close() error {
+	return c.closer.Close()
+}
+
+func (c *framedCodec) UnmarshalArgs(msg *birpc.Message, args interface{}) error {
+	return unmarshalArgs(msg, args)
+}
+
+func (c *framedCodec) UnmarshalResult(msg *birpc.Message, result interface{}) error {
+	return unmarshalResult(msg, result)
+}
+
+func (c *framedCodec) Ping() error {
+	return nil
+}
+
+func (c *framedCodec) Pong() error {
+	return nil
+}
+
+func (c *framedCodec) SetPingHandler(handler func(string) error) {}
+func (c *framedCodec) SetPongHandler(handler func(string) error) {}
+
+// NewFramedCodec returns a codec that sends each JSON message in its
+// own length-prefixed frame, see package framing. Frames larger than
+// maxSize bytes (0 for framing.DefaultMaxFrameSize) and frames that
+// are not valid messages are skipped. If they are requests whose id
+// and function can be read, they are answered with an error and the
+// connection goes on; otherwise ReadMessage returns an error, ending
+// it. Frames more than framing.SkipSize bytes over maxSize always end
+// the connection.
+func NewFramedCodec(conn io.ReadWriteCloser, prefix framing.Prefix, maxSize int) *framedCodec {
+	c := &framedCodec{
+		w:      framing.NewWriter(conn, prefix, maxSize),
+		closer: conn,
+	}
+	c.timed.r = conn
+	c.r = framing.NewReader(&c.timed, prefix, maxSize)
+	return c
+}
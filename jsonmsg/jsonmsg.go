@@ -14,6 +14,34 @@ type codec struct {
 	sending sync.Mutex
 	enc     *json.Encoder
 	closer  io.Closer
+
+	// rest of a batch, only used by ReadMessage
+	queue []jsonMessage
+
+	// limits on incoming messages, only used by ReadMessage
+	limit    budgetReader
+	maxDepth int
+	// ends the stream, only used by ReadMessage
+	err error
+
+	// timeouts are set under sending; only reads use timed.conn
+	timed timedReader
+
+	// protected by sending
+	written     countingWriter
+	sizeHandler func(birpc.Direction, int)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += n
+	return n, err
 }
 
 // This is ugly, but i need to override the unmarshaling logic for
@@ -22,31 +50,132 @@ type codec struct {
 // can embed birpc.Message and just override the two fields I need to
 // change.
 type jsonMessage struct {
-	ID     uint64          `json:"id,string,omitempty"`
-	Func   string          `json:"fn,omitempty"`
-	Args   json.RawMessage `json:"args,omitempty"`
-	Result json.RawMessage `json:"result,omitempty"`
-	Error  *birpc.Error    `json:"error,omitempty"`
+	ID      wireID          `json:"id,omitempty"`
+	Func    string          `json:"fn,omitempty"`
+	Args    json.RawMessage `json:"args,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *birpc.Error    `json:"error,omitempty"`
+	Meta    birpc.Metadata  `json:"meta,omitempty"`
+	Channel string          `json:"ch,omitempty"`
+
+	// returned by ReadMessage in place of the message
+	err error
 }
 
-func (c *codec) ReadMessage(msg *birpc.Message) error {
-	var jm jsonMessage
-	err := c.dec.Decode(&jm)
-	if err != nil {
-		return err
+// wireID is a message ID as sent by jsonmsg peers: a JSON string, or a
+// number from peers that encoded birpc.Message directly.
+type wireID uint64
+
+func (id *wireID) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		data = []byte(s)
 	}
-	msg.ID = jm.ID
+	return json.Unmarshal(data, (*uint64)(id))
+}
+
+// outMessage is what we send. Encoding birpc.Message directly would
+// send the ID as a number, which jsonMessage used to reject, and send
+// "id":0 for untagged requests.
+type outMessage struct {
+	ID      uint64         `json:"id,string,omitempty"`
+	Func    string         `json:"fn,omitempty"`
+	Args    interface{}    `json:"args,omitempty"`
+	Result  interface{}    `json:"result,omitempty"`
+	Error   *birpc.Error   `json:"error,omitempty"`
+	Meta    birpc.Metadata `json:"meta,omitempty"`
+	Channel string         `json:"ch,omitempty"`
+}
+
+func newOutMessage(msg *birpc.Message) *outMessage {
+	return &outMessage{
+		ID:      msg.ID,
+		Func:    msg.Func,
+		Args:    msg.Args,
+		Result:  msg.Result,
+		Error:   msg.Error,
+		Meta:    msg.Meta,
+		Channel: msg.Channel,
+	}
+}
+
+func (jm *jsonMessage) toMessage(msg *birpc.Message) {
+	msg.ID = uint64(jm.ID)
 	msg.Func = jm.Func
 	msg.Args = jm.Args
 	msg.Result = jm.Result
 	msg.Error = jm.Error
+	msg.Meta = jm.Meta
+	msg.Channel = jm.Channel
+}
+
+func (c *codec) ReadMessage(msg *birpc.Message) error {
+	if c.err != nil {
+		return c.err
+	}
+	for len(c.queue) == 0 {
+		var raw json.RawMessage
+		offset := c.dec.InputOffset()
+		c.limit.reset()
+		c.timed.reset()
+		err := c.dec.Decode(&raw)
+		if _, ok := err.(errOverBudget); ok {
+			return c.tooLarge()
+		}
+		if err != nil {
+			return err
+		}
+		if c.sizeHandler != nil {
+			c.sizeHandler(birpc.Inbound, int(c.dec.InputOffset()-offset))
+		}
+		c.queue, err = unpack(raw, c.maxDepth)
+		if err != nil {
+			return err
+		}
+	}
+	jm := c.queue[0]
+	c.queue = c.queue[1:]
+	if jm.err != nil {
+		return jm.err
+	}
+	jm.toMessage(msg)
 	return nil
 }
 
 func (c *codec) WriteMessage(msg *birpc.Message) error {
 	c.sending.Lock()
 	defer c.sending.Unlock()
-	return c.enc.Encode(msg)
+	c.written.n = 0
+	c.setWriteDeadline()
+	err := c.timed.timeouts.Check(c.enc.Encode(newOutMessage(msg)), "write")
+	if err == nil && c.sizeHandler != nil {
+		c.sizeHandler(birpc.Outbound, c.written.n)
+	}
+	return err
+}
+
+// WriteBatch implements birpc.BatchWriter, sending the messages as
+// one JSON array.
+func (c *codec) WriteBatch(msgs []*birpc.Message) error {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	c.written.n = 0
+	c.setWriteDeadline()
+	err := c.timed.timeouts.Check(c.enc.Encode(newOutBatch(msgs)), "write")
+	if err == nil && c.sizeHandler != nil {
+		c.sizeHandler(birpc.Outbound, c.written.n)
+	}
+	return err
+}
+
+// SetSizeHandler implements birpc.SizeReporter.
+func (c *codec) SetSizeHandler(handler func(birpc.Direction, int)) {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	c.sizeHandler = handler
 }
 
 func (c *codec) Close() error {
@@ -54,6 +183,14 @@ func (c *codec) Close() error {
 }
 
 func (c *codec) UnmarshalArgs(msg *birpc.Message, args interface{}) error {
+	return unmarshalArgs(msg, args)
+}
+
+func (c *codec) UnmarshalResult(msg *birpc.Message, result interface{}) error {
+	return unmarshalResult(msg, result)
+}
+
+func unmarshalArgs(msg *birpc.Message, args interface{}) error {
 	raw := msg.Args.(json.RawMessage)
 	if raw == nil {
 		return nil
@@ -62,7 +199,7 @@ func (c *codec) UnmarshalArgs(msg *birpc.Message, args interface{}) error {
 	return err
 }
 
-func (c *codec) UnmarshalResult(msg *birpc.Message, result interface{}) error {
+func unmarshalResult(msg *birpc.Message, result interface{}) error {
 	raw := msg.Result.(json.RawMessage)
 	if raw == nil {
 		return errors.New("birpc.jsonmsg response must set result")
@@ -84,9 +221,13 @@ func (c *codec) SetPongHandler(handler func(string) error) {}
 
 func NewCodec(conn io.ReadWriteCloser) *codec {
 	c := &codec{
-		dec:    json.NewDecoder(conn),
-		enc:    json.NewEncoder(conn),
 		closer: conn,
 	}
+	c.timed.r = conn
+	c.limit.r = &c.timed
+	c.limit.budget = -1
+	c.dec = json.NewDecoder(&c.limit)
+	c.written.w = conn
+	c.enc = json.NewEncoder(&c.written)
 	return c
 }
@@ -1,12 +1,19 @@
 package jsonmsg_test
 
 import (
+	"bytes"
+	"compress/flate"
 	"encoding/json"
+	"errors"
 	"io"
 	"net"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/tv42/birpc"
+	"github.com/tv42/birpc/framing"
 	"github.com/tv42/birpc/jsonmsg"
 )
 
@@ -69,3 +76,584 @@ func TestServerNoArgs(t *testing.T) {
 		t.Fatalf("unexpected error from ServeCodec: %v", err)
 	}
 }
+
+// oldMessage is how jsonmsg used to read messages; it used to write
+// birpc.Message as is, with a numeric ID.
+type oldMessage struct {
+	ID   uint64          `json:"id,string,omitempty"`
+	Func string          `json:"fn,omitempty"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+func TestOldPeerCalls(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	registry := makeRegistry()
+	server := birpc.NewEndpoint(jsonmsg.NewCodec(s), registry)
+	server_err := make(chan error)
+	go func() {
+		server_err <- server.Serve()
+	}()
+
+	go json.NewEncoder(c).Encode(&birpc.Message{ID: 42, Func: "WordLength.Len", Args: Request{Word: "xyzzy"}})
+
+	var reply LowLevelReply
+	if err := json.NewDecoder(c).Decode(&reply); err != nil {
+		t.Fatalf("old peer can't decode reply: %s", err)
+	}
+	if reply.Id != 42 {
+		t.Fatalf("wrong reply: %v", reply.Id)
+	}
+	if reply.Result.Length != 5 {
+		t.Fatalf("got wrong answer: %v", reply.Result.Length)
+	}
+
+	c.Close()
+
+	err := <-server_err
+	if err != io.EOF {
+		t.Fatalf("unexpected error from ServeCodec: %v", err)
+	}
+}
+
+func TestCallOldPeer(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	client := birpc.NewEndpoint(jsonmsg.NewCodec(c), nil)
+	go client.Serve()
+
+	go func() {
+		var req oldMessage
+		if err := json.NewDecoder(s).Decode(&req); err != nil {
+			t.Errorf("old peer can't decode request: %s", err)
+			return
+		}
+		var args Request
+		json.Unmarshal(req.Args, &args)
+		json.NewEncoder(s).Encode(&birpc.Message{ID: req.ID, Result: Reply{Length: len(args.Word)}})
+	}()
+
+	var reply Reply
+	if err := client.Call("WordLength.Len", Request{Word: "xyzzy"}, &reply); err != nil {
+		t.Fatalf("call failed: %s", err)
+	}
+	if reply.Length != 5 {
+		t.Fatalf("got wrong answer: %v", reply.Length)
+	}
+}
+
+func TestFramedResync(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	registry := makeRegistry()
+	server := birpc.NewEndpoint(jsonmsg.NewFramedCodec(s, framing.Fixed32, 1024), registry)
+	server_err := make(chan error)
+	go func() {
+		server_err <- server.Serve()
+	}()
+
+	w := framing.NewWriter(c, framing.Fixed32, 0)
+	go func() {
+		w.WriteFrame([]byte(`{"id":"40", "fn":"WordLength.Len", "args":`))
+		w.WriteFrame([]byte(`{"id":"41", "fn":"WordLength.Len", "args":{"Word":"` + strings.Repeat("x", 2048) + `"}}`))
+		w.WriteFrame([]byte(`{"id":"42", "fn":"WordLength.Len", "args":{"Word":"xyzzy"}}`))
+		// nothing to answer
+		w.WriteFrame([]byte(`{"id":`))
+	}()
+
+	r := framing.NewReader(c, framing.Fixed32, 0)
+	for _, id := range []uint64{40, 41} {
+		buf, err := r.ReadFrame()
+		if err != nil {
+			t.Fatalf("read failed: %s", err)
+		}
+		var reply LowLevelReply
+		if err := json.Unmarshal(buf, &reply); err != nil {
+			t.Fatalf("decode failed: %s", err)
+		}
+		if reply.Id != id || reply.Error == nil {
+			t.Fatalf("expected an error for %d: %#v", id, reply)
+		}
+	}
+
+	buf, err := r.ReadFrame()
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	var reply LowLevelReply
+	if err := json.Unmarshal(buf, &reply); err != nil {
+		t.Fatalf("decode failed: %s", err)
+	}
+	t.Logf("reply msg: %#v", reply)
+	if reply.Id != 42 {
+		t.Fatalf("wrong reply: %v", reply.Id)
+	}
+	if reply.Result.Length != 5 {
+		t.Fatalf("got wrong answer: %v", reply.Result.Length)
+	}
+
+	err = <-server_err
+	if err == nil || err == io.EOF {
+		t.Fatalf("expected a decoding error from ServeCodec: %v", err)
+	}
+}
+
+// recordingConn keeps a copy of everything written to it.
+type recordingConn struct {
+	net.Conn
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (r *recordingConn) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	r.buf.Write(p)
+	r.mu.Unlock()
+	return r.Conn.Write(p)
+}
+
+func (r *recordingConn) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.String()
+}
+
+func testCompressedCall(t *testing.T, client *birpc.Endpoint) {
+	word := strings.Repeat("saippuakauppias", 100)
+	for i := 0; i < 3; i++ {
+		reply := &Reply{}
+		if err := client.Call("WordLength.Len", &Request{word}, reply); err != nil {
+			t.Fatalf("unexpected error from call: %v", err)
+		}
+		if reply.Length != len(word) {
+			t.Fatalf("got wrong answer: %v", reply.Length)
+		}
+	}
+}
+
+func TestCompressed(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	rec := &recordingConn{Conn: c}
+	server := birpc.NewEndpoint(jsonmsg.NewCompressedCodec(s, 9), makeRegistry())
+	client := birpc.NewEndpoint(jsonmsg.NewCompressedCodec(rec, 9), nil)
+	go server.Serve()
+	go client.Serve()
+
+	// compression starts once the offers have crossed, so keep
+	// calling until it has
+	testCompressedCall(t, client)
+	testCompressedCall(t, client)
+
+	sent := rec.String()
+	if !strings.Contains(sent, `"fn":"birpc.deflate.start"`) {
+		t.Fatalf("client never started compressing: %q", sent)
+	}
+	after := sent[strings.Index(sent, "birpc.deflate.start"):]
+	if strings.Contains(after, "saippuakauppias") {
+		t.Errorf("client sent plain text after starting compression")
+	}
+}
+
+func TestCompressedWithPlainPeer(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	rec := &recordingConn{Conn: c}
+	server := birpc.NewEndpoint(jsonmsg.NewCodec(s), makeRegistry())
+	client := birpc.NewEndpoint(jsonmsg.NewCompressedCodec(rec, 9), makeRegistry())
+	go server.Serve()
+	go client.Serve()
+
+	testCompressedCall(t, client)
+
+	// and the other way around
+	reply := &Reply{}
+	if err := server.Call("WordLength.Len", &Request{"xyzzy"}, reply); err != nil {
+		t.Fatalf("unexpected error from call: %v", err)
+	}
+	if reply.Length != 5 {
+		t.Fatalf("got wrong answer: %v", reply.Length)
+	}
+
+	if strings.Contains(rec.String(), "birpc.deflate.start") {
+		t.Errorf("client compressed for a plain peer")
+	}
+}
+
+func TestBatchRead(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	server := birpc.NewEndpoint(jsonmsg.NewCodec(s), makeRegistry())
+	server_err := make(chan error)
+	go func() {
+		server_err <- server.Serve()
+	}()
+
+	io.WriteString(c, `[{"id":"1","fn":"WordLength.Len","args":{"Word":"a"}},{"id":"2","fn":"WordLength.Len","args":{"Word":"bb"}}]`+"\n")
+
+	dec := json.NewDecoder(c)
+	got := map[uint64]int{}
+	for i := 0; i < 2; i++ {
+		var reply LowLevelReply
+		if err := dec.Decode(&reply); err != nil {
+			t.Fatalf("decode failed: %s", err)
+		}
+		got[reply.Id] = reply.Result.Length
+	}
+	if got[1] != 1 || got[2] != 2 {
+		t.Errorf("wrong answers: %v", got)
+	}
+
+	c.Close()
+	if err := <-server_err; err != io.EOF {
+		t.Fatalf("unexpected error from ServeCodec: %v", err)
+	}
+}
+
+func TestBatchWindow(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	rec := &recordingConn{Conn: c}
+	server := birpc.NewEndpoint(jsonmsg.NewCodec(s), makeRegistry())
+	client := birpc.NewEndpoint(jsonmsg.NewCodec(rec), nil)
+	client.SetHello(birpc.DefaultHello())
+	client.SetBatchWindow(20 * time.Millisecond)
+	go server.Serve()
+	go client.Serve()
+
+	<-client.HandshakeDone()
+	if !client.Capabilities().Has(birpc.FeatureBatch) {
+		t.Fatalf("batching not negotiated")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			word := strings.Repeat("x", i)
+			reply := &Reply{}
+			if err := client.Call("WordLength.Len", &Request{word}, reply); err != nil {
+				t.Errorf("unexpected error from call: %v", err)
+				return
+			}
+			if reply.Length != i {
+				t.Errorf("got wrong answer: %v != %v", reply.Length, i)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if !strings.Contains(rec.String(), `[{"id":"`) {
+		t.Errorf("calls were not batched: %q", rec.String())
+	}
+}
+
+func TestBatchRejects(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	server := birpc.NewEndpoint(jsonmsg.NewCodec(s), makeRegistry())
+	server.SetHello(birpc.DefaultHello())
+	server.SetBatchWindow(50 * time.Millisecond)
+	go server.Serve()
+	dec := json.NewDecoder(c)
+
+	io.WriteString(c, `{"id":"9","fn":"birpc.hello","args":{"version":1,"features":["batch"]}}`+"\n")
+	// the hello of the server
+	var hello json.RawMessage
+	if err := dec.Decode(&hello); err != nil {
+		t.Fatalf("decode failed: %s", err)
+	}
+
+	// the read loop queues the first reject without waiting for it
+	// to be sent, so both go in one batch
+	io.WriteString(c, `{"id":"1","fn":"Nope.Nope"}`+"\n")
+	io.WriteString(c, `{"id":"2","fn":"Nope.Nope"}`+"\n")
+	var got []LowLevelReply
+	if err := dec.Decode(&got); err != nil {
+		t.Fatalf("decode failed: %s", err)
+	}
+	rejected := 0
+	for _, reply := range got {
+		if reply.Error != nil {
+			rejected++
+		}
+	}
+	if rejected != 2 {
+		t.Errorf("expected both rejects in one batch: %+v", got)
+	}
+}
+
+func TestFramedBatch(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	server := birpc.NewEndpoint(jsonmsg.NewFramedCodec(s, framing.Varint, 0), makeRegistry())
+	go server.Serve()
+	client := jsonmsg.NewFramedCodec(c, framing.Varint, 0)
+
+	batch := []*birpc.Message{
+		{ID: 1, Func: "WordLength.Len", Args: &Request{"a"}},
+		{ID: 2, Func: "WordLength.Len", Args: &Request{"bb"}},
+	}
+	go client.WriteBatch(batch)
+
+	got := map[uint64]int{}
+	for i := 0; i < 2; i++ {
+		var msg birpc.Message
+		if err := client.ReadMessage(&msg); err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		var reply Reply
+		if err := client.UnmarshalResult(&msg, &reply); err != nil {
+			t.Fatalf("unmarshal failed: %v", err)
+		}
+		got[msg.ID] = reply.Length
+	}
+	if got[1] != 1 || got[2] != 2 {
+		t.Errorf("wrong answers: %v", got)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	codec := jsonmsg.NewCodec(s)
+	codec.SetLimits(200, 3)
+	server := birpc.NewEndpoint(codec, makeRegistry())
+	server_err := make(chan error)
+	go func() {
+		server_err <- server.Serve()
+	}()
+	dec := json.NewDecoder(c)
+
+	// error codes are only sent once negotiated
+	io.WriteString(c, `{"id":"9","fn":"birpc.hello","args":{"version":1,"features":["error-codes"]}}`+"\n")
+	var hello json.RawMessage
+	if err := dec.Decode(&hello); err != nil {
+		t.Fatalf("decode failed: %s", err)
+	}
+
+	// too deep, but the stream goes on
+	io.WriteString(c, `{"id":"1","fn":"WordLength.Len","args":{"Word":[[[["a"]]]]}}`+"\n")
+	var reply LowLevelReply
+	if err := dec.Decode(&reply); err != nil {
+		t.Fatalf("decode failed: %s", err)
+	}
+	if reply.Id != 1 || reply.Error == nil || reply.Error.Code != birpc.CodeInvalidRequest {
+		t.Fatalf("expected an invalid request error: %+v", reply)
+	}
+
+	io.WriteString(c, `{"id":"2","fn":"WordLength.Len","args":{"Word":"abc"}}`+"\n")
+	reply = LowLevelReply{}
+	if err := dec.Decode(&reply); err != nil {
+		t.Fatalf("decode failed: %s", err)
+	}
+	if reply.Id != 2 || reply.Error != nil || reply.Result.Length != 3 {
+		t.Fatalf("unexpected reply: %+v", reply)
+	}
+
+	// in a batch, only the request too deep is refused
+	io.WriteString(c, `[{"id":"4","fn":"WordLength.Len","args":{"Word":[[[["a"]]]]}},{"id":"5","fn":"WordLength.Len","args":{"Word":"abcd"}}]`+"\n")
+	got := map[uint64]LowLevelReply{}
+	for i := 0; i < 2; i++ {
+		reply = LowLevelReply{}
+		if err := dec.Decode(&reply); err != nil {
+			t.Fatalf("decode failed: %s", err)
+		}
+		got[reply.Id] = reply
+	}
+	if e := got[4].Error; e == nil || e.Code != birpc.CodeInvalidRequest {
+		t.Fatalf("expected an invalid request error: %+v", got[4])
+	}
+	if r := got[5]; r.Error != nil || r.Result.Length != 4 {
+		t.Fatalf("unexpected reply: %+v", r)
+	}
+
+	// too large, answered before giving up on the stream; the
+	// rest of it is never read
+	go io.WriteString(c, `{"id":"3","fn":"WordLength.Len","args":{"Word":"`+strings.Repeat("x", 1000)+`"}}`+"\n")
+	reply = LowLevelReply{}
+	if err := dec.Decode(&reply); err != nil {
+		t.Fatalf("decode failed: %s", err)
+	}
+	if reply.Id != 3 || reply.Error == nil || reply.Error.Code != birpc.CodeInvalidRequest {
+		t.Fatalf("expected an invalid request error: %+v", reply)
+	}
+	err := <-server_err
+	var tooLarge *birpc.MessageTooLargeError
+	if !errors.As(err, &tooLarge) || tooLarge.Max != 200 {
+		t.Fatalf("expected MessageTooLargeError: %v", err)
+	}
+}
+
+func TestCompressedLimits(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	codec := jsonmsg.NewCompressedCodec(s, 9)
+	codec.SetLimits(200, 3)
+	server := birpc.NewEndpoint(codec, makeRegistry())
+	server_err := make(chan error)
+	go func() {
+		server_err <- server.Serve()
+	}()
+
+	go func() {
+		io.WriteString(c, `{"fn":"birpc.deflate.start"}`)
+		fw, _ := flate.NewWriter(c, flate.BestCompression)
+		io.WriteString(fw, `{"id":"1","fn":"WordLength.Len","args":{"Word":[[[["a"]]]]}}`)
+		fw.Flush()
+		// small on the wire, but not once inflated
+		io.WriteString(fw, `{"id":"2","fn":"WordLength.Len","args":{"Word":"`+strings.Repeat("x", 10<<20)+`"}}`)
+		fw.Flush()
+	}()
+
+	dec := json.NewDecoder(c)
+	for _, id := range []uint64{1, 2} {
+		var reply LowLevelReply
+		for reply.Id == 0 {
+			// skip the offer of the server
+			if err := dec.Decode(&reply); err != nil {
+				t.Fatalf("decode failed: %s", err)
+			}
+		}
+		if reply.Id != id || reply.Error == nil {
+			t.Fatalf("expected an error for %d: %+v", id, reply)
+		}
+	}
+	var tooLarge *birpc.MessageTooLargeError
+	if err := <-server_err; !errors.As(err, &tooLarge) {
+		t.Fatalf("expected MessageTooLargeError: %v", err)
+	}
+}
+
+func TestFramedLimits(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	codec := jsonmsg.NewFramedCodec(s, framing.Varint, 0)
+	codec.SetLimits(200, 3)
+	server := birpc.NewEndpoint(codec, makeRegistry())
+	go server.Serve()
+
+	w := framing.NewWriter(c, framing.Varint, 0)
+	go func() {
+		w.WriteFrame([]byte(`{"id":"1","fn":"WordLength.Len","args":{"Word":[[[["a"]]]]}}`))
+		w.WriteFrame([]byte(`{"id":"2","fn":"WordLength.Len","args":{"Word":"` + strings.Repeat("x", 1000) + `"}}`))
+		w.WriteFrame([]byte(`{"id":"3","fn":"WordLength.Len","args":{"Word":"abc"}}`))
+	}()
+
+	r := framing.NewReader(c, framing.Varint, 0)
+	for _, id := range []uint64{1, 2, 3} {
+		buf, err := r.ReadFrame()
+		if err != nil {
+			t.Fatalf("read failed: %s", err)
+		}
+		var reply LowLevelReply
+		if err := json.Unmarshal(buf, &reply); err != nil {
+			t.Fatalf("decode failed: %s", err)
+		}
+		if reply.Id != id || (reply.Error == nil) != (id == 3) {
+			t.Fatalf("unexpected reply for %d: %+v", id, reply)
+		}
+	}
+}
+
+// timedCodec is a codec with timeouts.
+type timedCodec interface {
+	birpc.Codec
+	SetTimeouts(birpc.Timeouts) error
+}
+
+// frame returns buf as a varint framed frame.
+func frame(buf string) string {
+	var b bytes.Buffer
+	framing.NewWriter(&b, framing.Varint, 0).WriteFrame([]byte(buf))
+	return b.String()
+}
+
+func TestTimeouts(t *testing.T) {
+	serve := func(codec timedCodec, timeouts birpc.Timeouts, c net.Conn, client func(c net.Conn)) error {
+		defer c.Close()
+		if err := codec.SetTimeouts(timeouts); err != nil {
+			t.Fatalf("SetTimeouts: %v", err)
+		}
+		server := birpc.NewEndpoint(codec, makeRegistry())
+		server_err := make(chan error)
+		go func() {
+			server_err <- server.Serve()
+		}()
+		client(c)
+		return <-server_err
+	}
+
+	const request = `{"id":"1","fn":"WordLength.Len","args":{"Word":"a"}}`
+	for _, codec := range []struct {
+		name string
+		new  func(conn net.Conn) timedCodec
+		// a request, and the start of one
+		request, partial string
+	}{
+		{
+			"plain",
+			func(conn net.Conn) timedCodec { return jsonmsg.NewCodec(conn) },
+			request + "\n", request[:20],
+		},
+		{
+			"framed",
+			func(conn net.Conn) timedCodec { return jsonmsg.NewFramedCodec(conn, framing.Varint, 0) },
+			frame(request), frame(request)[:20],
+		},
+		{
+			"compressed",
+			func(conn net.Conn) timedCodec { return jsonmsg.NewCompressedCodec(conn, 9) },
+			request + "\n", request[:20],
+		},
+	} {
+		for _, test := range []struct {
+			op     string
+			client func(c net.Conn)
+		}{
+			// says nothing
+			{"idle", func(c net.Conn) {}},
+			// stops in the middle of a message
+			{"read", func(c net.Conn) {
+				io.WriteString(c, codec.partial)
+			}},
+			// never reads the reply
+			{"write", func(c net.Conn) {
+				io.WriteString(c, codec.request)
+			}},
+		} {
+			timeouts := birpc.Timeouts{Idle: time.Hour, Read: time.Hour, Write: time.Hour}
+			switch test.op {
+			case "idle":
+				timeouts.Idle = 50 * time.Millisecond
+			case "read":
+				timeouts.Read = 50 * time.Millisecond
+			case "write":
+				timeouts.Write = 50 * time.Millisecond
+			}
+			c, s := net.Pipe()
+			err := serve(codec.new(s), timeouts, c, test.client)
+			var timeout *birpc.TimeoutError
+			if !errors.As(err, &timeout) {
+				t.Errorf("%s %s: expected TimeoutError: %v", codec.name, test.op, err)
+				continue
+			}
+			if timeout.Op != test.op || timeout.Timeout != 50*time.Millisecond {
+				t.Errorf("%s %s: wrong timeout: %v", codec.name, test.op, timeout)
+			}
+		}
+	}
+}
+
+func TestTimeoutsNeedDeadlines(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	codec := jsonmsg.NewCodec(struct {
+		io.Reader
+		io.WriteCloser
+	}{r, w})
+	if err := codec.SetTimeouts(birpc.Timeouts{Idle: time.Second}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
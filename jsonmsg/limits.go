@@ -0,0 +1,86 @@
+package jsonmsg
+
+import (
+	"io"
+
+	"github.com/tv42/birpc"
+	"github.com/tv42/birpc/internal/jsonlimit"
+)
+
+// budgetReader fails reads once its budget is spent.
+type budgetReader struct {
+	r io.Reader
+	// budget < 0 means no limit
+	budget int64
+	// read is what was read since the budget was last set
+	read []byte
+	max  int64
+}
+
+// errOverBudget is what the json.Decoder sees when a message is too
+// large; ReadMessage turns it into a better error.
+type errOverBudget struct{}
+
+func (errOverBudget) Error() string { return "jsonmsg: over budget" }
+
+func (br *budgetReader) Read(p []byte) (int, error) {
+	if br.budget < 0 {
+		return br.r.Read(p)
+	}
+	if br.budget == 0 {
+		return 0, errOverBudget{}
+	}
+	if int64(len(p)) > br.budget {
+		p = p[:br.budget]
+	}
+	n, err := br.r.Read(p)
+	br.budget -= int64(n)
+	// keep the start of the message, to find its id if it's too large
+	if keep := peekSize - len(br.read); keep > 0 {
+		if keep > n {
+			keep = n
+		}
+		br.read = append(br.read, p[:keep]...)
+	}
+	return n, err
+}
+
+// peekSize is how much of an oversized message is kept to look for
+// its id.
+const peekSize = 4096
+
+// reset gives the reader the budget of one message.
+func (br *budgetReader) reset() {
+	if br.max <= 0 {
+		br.budget = -1
+		return
+	}
+	br.budget = br.max
+	br.read = br.read[:0]
+}
+
+// SetLimits bounds incoming messages to maxSize bytes, and their
+// arguments to maxDepth levels of nested arrays and objects. Zero
+// means no limit. The size is approximate, as data read ahead is
+// counted against the message being read.
+//
+// As the stream can't be resynchronized, a message over maxSize ends
+// the connection: ReadMessage returns a *birpc.MessageTooLargeError,
+// after a *birpc.RequestError for Serve to answer if the id of the
+// request could be read.
+// A request nested too deeply is answered with an error, if its id
+// can be read; otherwise ReadMessage returns a
+// *birpc.MessageTooDeepError. The requests of a batch are checked one
+// by one. Must be called before Serve.
+func (c *codec) SetLimits(maxSize int64, maxDepth int) {
+	c.limit.max = maxSize
+	c.maxDepth = maxDepth
+}
+
+// tooLarge returns the error for a message over the size limit: the
+// request, so Serve answers it, if its id could be read. Either way,
+// the stream can't go on, so the next ReadMessage ends it.
+func (c *codec) tooLarge() error {
+	c.err = &birpc.MessageTooLargeError{Max: c.limit.max}
+	return jsonlimit.TooLarge(c.limit.read, c.limit.max)
+}
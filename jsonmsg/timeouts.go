@@ -0,0 +1,80 @@
+package jsonmsg
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/tv42/birpc"
+)
+
+// deadliner is implemented by connections that support timeouts,
+// such as net.Conn.
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// timedReader moves the read deadline from the idle timeout to the
+// read timeout as soon as a message starts.
+type timedReader struct {
+	r        io.Reader
+	conn     deadliner
+	timeouts birpc.Timeouts
+	started  bool
+}
+
+func (tr *timedReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	if tr.conn == nil {
+		return n, err
+	}
+	op := "read"
+	if !tr.started {
+		op = "idle"
+		if n > 0 {
+			tr.started = true
+			tr.conn.SetReadDeadline(tr.timeouts.Deadline(tr.timeouts.Read))
+		}
+	}
+	return n, tr.timeouts.Check(err, op)
+}
+
+// reset waits for the next message.
+func (tr *timedReader) reset() {
+	if tr.conn == nil {
+		return
+	}
+	tr.started = false
+	tr.conn.SetReadDeadline(tr.timeouts.Deadline(tr.timeouts.Idle))
+}
+
+var errNoDeadlines = errors.New("jsonmsg: connection does not support deadlines")
+
+// SetTimeouts bounds how long reads and writes wait for the peer. The
+// connection must support deadlines, like a net.Conn does. When a
+// timeout expires, the connection is unusable and Serve returns a
+// *birpc.TimeoutError. Must be called before Serve.
+func (c *codec) SetTimeouts(t birpc.Timeouts) error {
+	conn, ok := c.closer.(deadliner)
+	if !ok {
+		return errNoDeadlines
+	}
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	if t.Idle != 0 || t.Read != 0 {
+		c.timed.conn = conn
+	}
+	c.timed.timeouts = t
+	return nil
+}
+
+// setWriteDeadline starts a write; c.sending must be held.
+func (c *codec) setWriteDeadline() {
+	if c.timed.timeouts.Write == 0 {
+		return
+	}
+	if conn, ok := c.closer.(deadliner); ok {
+		conn.SetWriteDeadline(c.timed.timeouts.Deadline(c.timed.timeouts.Write))
+	}
+}
@@ -0,0 +1,495 @@
+// Package jsonrpc2 is a birpc Codec speaking JSON-RPC 2.0, over any
+// io.ReadWriteCloser or a WebSocket.
+//
+// Requests with an ID of 0 are sent as notifications, and incoming
+// notifications (no ID, or a null ID) are delivered as untagged
+// requests. The IDs of incoming requests may be any JSON string or
+// number; they are remembered by the codec and restored on the
+// response. birpc.Error codes are passed through as JSON-RPC error
+// codes, with errors that have no code reported as -32000; the codec
+// is a birpc.ErrorCoder, so no hello is needed for that.
+//
+// Incoming batches are unpacked, and their responses are collected
+// into a single batch response.
+//
+// JSON-RPC 2.0 has no room for birpc metadata or channels; the codec
+// is a birpc.ChannelCarrier that says so.
+package jsonrpc2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+
+	"github.com/tv42/birpc"
+)
+
+// CodeServerError is sent for method errors that carry no code of
+// their own.
+const CodeServerError = -32000
+
+const version = "2.0"
+
+var null = json.RawMessage("null")
+
+type errorObject struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// wireMessage is both a request and a response, as we only know
+// which one it is after looking at the fields.
+type wireMessage struct {
+	Version string          `json:"jsonrpc"`
+	Method  json.RawMessage `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *errorObject    `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+type request struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      *uint64         `json:"id,omitempty"`
+}
+
+type response struct {
+	Version string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *errorObject    `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// batch collects the responses to an incoming batch, so they can be
+// sent together.
+type batch struct {
+	pending   int
+	responses []json.RawMessage
+}
+
+type incoming struct {
+	id    json.RawMessage
+	batch *batch
+}
+
+// transport moves whole JSON values.
+type transport interface {
+	// read returns the next JSON value. A *json.SyntaxError means
+	// the peer sent garbage; the transport may or may not be
+	// usable after that.
+	read() (json.RawMessage, error)
+	// resync reports whether reading can continue after a syntax
+	// error.
+	resync() bool
+	write([]byte) error
+	ping() error
+	pong() error
+	setPingHandler(func(string) error)
+	setPongHandler(func(string) error)
+	io.Closer
+}
+
+type codec struct {
+	t transport
+
+	readMu  sync.Mutex
+	writeMu sync.Mutex
+
+	// protects seq and ids
+	mu  sync.Mutex
+	seq uint64
+	ids map[uint64]incoming
+
+	// rest of an incoming batch, only touched by ReadMessage
+	queue []*birpc.Message
+}
+
+// CarriesErrorCodes implements birpc.ErrorCoder, as every JSON-RPC
+// 2.0 error has a code.
+func (c *codec) CarriesErrorCodes() bool {
+	return true
+}
+
+// CarriesChannels implements birpc.ChannelCarrier.
+func (c *codec) CarriesChannels() bool {
+	return false
+}
+
+func newCodec(t transport) *codec {
+	return &codec{
+		t:   t,
+		ids: make(map[uint64]incoming),
+	}
+}
+
+func isStructured(raw json.RawMessage) bool {
+	raw = bytes.TrimLeft(raw, " \t\r\n")
+	return len(raw) > 0 && (raw[0] == '{' || raw[0] == '[')
+}
+
+func isBatch(raw json.RawMessage) bool {
+	raw = bytes.TrimLeft(raw, " \t\r\n")
+	return len(raw) > 0 && raw[0] == '['
+}
+
+func validID(raw json.RawMessage) bool {
+	if raw == nil {
+		return true
+	}
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return false
+	}
+	switch v.(type) {
+	case nil, string, float64:
+		return true
+	}
+	return false
+}
+
+func (c *codec) ReadMessage(msg *birpc.Message) error {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.queue) == 0 {
+		raw, err := c.t.read()
+		if err != nil {
+			var syntax *json.SyntaxError
+			if errors.As(err, &syntax) {
+				c.reject(nil, nil, birpc.CodeParseError, "Parse error")
+				if c.t.resync() {
+					continue
+				}
+			}
+			return err
+		}
+		c.unpack(raw)
+	}
+
+	*msg = *c.queue[0]
+	c.queue[0] = nil
+	c.queue = c.queue[1:]
+	return nil
+}
+
+// unpack queues the messages in a single value or batch, answering
+// invalid ones directly.
+func (c *codec) unpack(raw json.RawMessage) {
+	if !isBatch(raw) {
+		if m := c.decode(raw, nil); m != nil {
+			c.queue = append(c.queue, m)
+		}
+		return
+	}
+
+	var elems []json.RawMessage
+	if err := json.Unmarshal(raw, &elems); err != nil {
+		c.reject(nil, nil, birpc.CodeParseError, "Parse error")
+		return
+	}
+	if len(elems) == 0 {
+		c.reject(nil, nil, birpc.CodeInvalidRequest, "Invalid Request")
+		return
+	}
+
+	b := &batch{}
+	// hold the batch open until every element is looked at, so
+	// fast responses can't complete it early
+	c.mu.Lock()
+	b.pending++
+	c.mu.Unlock()
+	for _, elem := range elems {
+		if m := c.decode(elem, b); m != nil {
+			c.queue = append(c.queue, m)
+		}
+	}
+	c.finish(b, nil)
+}
+
+// decode converts one JSON-RPC object to a birpc.Message. Invalid
+// objects are answered and nil is returned.
+func (c *codec) decode(raw json.RawMessage, b *batch) *birpc.Message {
+	var wm wireMessage
+	if err := json.Unmarshal(raw, &wm); err != nil {
+		c.reject(nil, b, birpc.CodeInvalidRequest, "Invalid Request")
+		return nil
+	}
+	if wm.Version != version || !validID(wm.ID) {
+		c.reject(nil, b, birpc.CodeInvalidRequest, "Invalid Request")
+		return nil
+	}
+
+	if wm.Method == nil {
+		if wm.Result == nil && wm.Error == nil {
+			c.reject(wm.ID, b, birpc.CodeInvalidRequest, "Invalid Request")
+			return nil
+		}
+		// a response to one of our requests
+		var id uint64
+		if err := json.Unmarshal(wm.ID, &id); err != nil || id == 0 {
+			// null ID: the peer could not parse our request
+			// enough to tell which one it was; there is nobody
+			// to deliver this to
+			return nil
+		}
+		msg := &birpc.Message{
+			ID:     id,
+			Result: wm.Result,
+		}
+		if wm.Error != nil {
+			msg.Error = &birpc.Error{
+				Msg:  wm.Error.Message,
+				Code: wm.Error.Code,
+			}
+		}
+		return msg
+	}
+
+	var method string
+	if err := json.Unmarshal(wm.Method, &method); err != nil || method == "" {
+		c.reject(wm.ID, b, birpc.CodeInvalidRequest, "Invalid Request")
+		return nil
+	}
+	if wm.Params != nil && !isStructured(wm.Params) {
+		c.reject(wm.ID, b, birpc.CodeInvalidRequest, "Invalid Request")
+		return nil
+	}
+
+	msg := &birpc.Message{
+		Func: method,
+		Args: wm.Params,
+	}
+	if wm.ID != nil && !bytes.Equal(wm.ID, null) {
+		c.mu.Lock()
+		c.seq++
+		msg.ID = c.seq
+		c.ids[msg.ID] = incoming{id: wm.ID, batch: b}
+		if b != nil {
+			b.pending++
+		}
+		c.mu.Unlock()
+	}
+	return msg
+}
+
+// reject answers an invalid message, as part of batch b if not nil.
+func (c *codec) reject(id json.RawMessage, b *batch, code int, message string) {
+	if id == nil {
+		id = null
+	}
+	resp := response{
+		Version: version,
+		Error:   &errorObject{Code: code, Message: message},
+		ID:      id,
+	}
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+	if b != nil {
+		c.mu.Lock()
+		b.responses = append(b.responses, buf)
+		c.mu.Unlock()
+		return
+	}
+	// errors will resurface on the next read or write
+	_ = c.send(buf)
+}
+
+// finish records one completed element of batch b, sending the batch
+// response once all are done.
+func (c *codec) finish(b *batch, buf json.RawMessage) error {
+	c.mu.Lock()
+	if buf != nil {
+		b.responses = append(b.responses, buf)
+	}
+	b.pending--
+	done := b.pending == 0
+	c.mu.Unlock()
+	if !done || len(b.responses) == 0 {
+		return nil
+	}
+	out, err := json.Marshal(b.responses)
+	if err != nil {
+		return err
+	}
+	return c.send(out)
+}
+
+func (c *codec) send(buf []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.t.write(buf)
+}
+
+func (c *codec) WriteMessage(msg *birpc.Message) error {
+	if msg.Func != "" {
+		return c.writeRequest(msg)
+	}
+	return c.writeResponse(msg)
+}
+
+func (c *codec) writeRequest(msg *birpc.Message) error {
+	req := request{
+		Version: version,
+		Method:  msg.Func,
+	}
+	if msg.ID != 0 {
+		id := msg.ID
+		req.ID = &id
+	}
+	if msg.Args != nil {
+		params, err := json.Marshal(msg.Args)
+		if err != nil {
+			return err
+		}
+		if !isStructured(params) {
+			// params must be an object or an array
+			params = append(append(json.RawMessage("["), params...), ']')
+		}
+		req.Params = params
+	}
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return c.send(buf)
+}
+
+func (c *codec) writeResponse(msg *birpc.Message) error {
+	c.mu.Lock()
+	in, found := c.ids[msg.ID]
+	delete(c.ids, msg.ID)
+	c.mu.Unlock()
+	if !found {
+		// notifications are never answered
+		return nil
+	}
+
+	resp := response{
+		Version: version,
+		ID:      in.id,
+	}
+	if msg.Error != nil {
+		code := msg.Error.Code
+		if code == 0 {
+			code = CodeServerError
+		}
+		resp.Error = &errorObject{Code: code, Message: msg.Error.Msg}
+	} else {
+		result, err := json.Marshal(msg.Result)
+		if err != nil {
+			return err
+		}
+		resp.Result = result
+	}
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	if in.batch != nil {
+		return c.finish(in.batch, buf)
+	}
+	return c.send(buf)
+}
+
+func (c *codec) UnmarshalArgs(msg *birpc.Message, args interface{}) error {
+	raw := msg.Args.(json.RawMessage)
+	if raw == nil {
+		return nil
+	}
+	if isBatch(raw) {
+		// a single positional parameter for a method that does
+		// not take a list
+		kind := reflect.Indirect(reflect.ValueOf(args)).Kind()
+		if kind != reflect.Slice && kind != reflect.Array {
+			var list []json.RawMessage
+			if err := json.Unmarshal(raw, &list); err != nil {
+				return err
+			}
+			if len(list) != 1 {
+				return errors.New("birpc.jsonrpc2: expected one positional parameter")
+			}
+			raw = list[0]
+		}
+	}
+	return json.Unmarshal(raw, args)
+}
+
+func (c *codec) UnmarshalResult(msg *birpc.Message, result interface{}) error {
+	raw := msg.Result.(json.RawMessage)
+	if raw == nil {
+		return errors.New("birpc.jsonrpc2 response must set result")
+	}
+	return json.Unmarshal(raw, result)
+}
+
+func (c *codec) Ping() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.t.ping()
+}
+
+func (c *codec) Pong() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.t.pong()
+}
+
+func (c *codec) SetPingHandler(handler func(string) error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	c.t.setPingHandler(handler)
+}
+
+func (c *codec) SetPongHandler(handler func(string) error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	c.t.setPongHandler(handler)
+}
+
+func (c *codec) Close() error {
+	return c.t.Close()
+}
+
+type stream struct {
+	dec    *json.Decoder
+	w      io.Writer
+	closer io.Closer
+}
+
+func (s *stream) read() (json.RawMessage, error) {
+	var raw json.RawMessage
+	err := s.dec.Decode(&raw)
+	return raw, err
+}
+
+// A json.Decoder is stuck after a syntax error.
+func (s *stream) resync() bool { return false }
+
+func (s *stream) write(buf []byte) error {
+	_, err := s.w.Write(append(buf, '\n'))
+	return err
+}
+
+func (s *stream) ping() error                       { return nil }
+func (s *stream) pong() error                       { return nil }
+func (s *stream) setPingHandler(func(string) error) {}
+func (s *stream) setPongHandler(func(string) error) {}
+func (s *stream) Close() error                      { return s.closer.Close() }
+
+// NewCodec returns a JSON-RPC 2.0 codec that sends newline-separated
+// JSON over conn.
+func NewCodec(conn io.ReadWriteCloser) *codec {
+	return newCodec(&stream{
+		dec:    json.NewDecoder(conn),
+		w:      conn,
+		closer: conn,
+	})
+}
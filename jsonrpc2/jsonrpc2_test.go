@@ -0,0 +1,332 @@
+package jsonrpc2_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tv42/birpc"
+	"github.com/tv42/birpc/jsonrpc2"
+)
+
+type Named struct {
+	Minuend    int `json:"minuend"`
+	Subtrahend int `json:"subtrahend"`
+}
+
+type Math struct{}
+
+func (Math) Subtract(args []int, reply *int) error {
+	if len(args) != 2 {
+		return errors.New("need two numbers")
+	}
+	*reply = args[0] - args[1]
+	return nil
+}
+
+func (Math) SubtractNamed(args Named, reply *int) error {
+	*reply = args.Minuend - args.Subtrahend
+	return nil
+}
+
+func (Math) Sum(args []int) (int, error) {
+	sum := 0
+	for _, n := range args {
+		sum += n
+	}
+	return sum, nil
+}
+
+func (Math) Double(args int) (int, error) {
+	return 2 * args, nil
+}
+
+func (Math) Update(args []int) error {
+	return nil
+}
+
+func (Math) Fail(args []int) error {
+	return &birpc.Error{Msg: "custom", Code: 42}
+}
+
+func makeRegistry() *birpc.Registry {
+	r := birpc.NewRegistry()
+	r.RegisterService(Math{})
+	return r
+}
+
+// serve starts an Endpoint on a pipe and returns the other end.
+func serve(t *testing.T) (net.Conn, chan error) {
+	c, s := net.Pipe()
+	server := birpc.NewEndpoint(jsonrpc2.NewCodec(s), makeRegistry())
+	server_err := make(chan error, 1)
+	go func() {
+		server_err <- server.Serve()
+	}()
+	return c, server_err
+}
+
+// Examples from the JSON-RPC 2.0 specification, with method names
+// adjusted to birpc conventions.
+var specExamples = []struct {
+	name string
+	req  string
+	resp string
+}{
+	{
+		"positional parameters",
+		`{"jsonrpc": "2.0", "method": "Math.Subtract", "params": [42, 23], "id": 1}`,
+		`{"jsonrpc": "2.0", "result": 19, "id": 1}`,
+	},
+	{
+		"named parameters",
+		`{"jsonrpc": "2.0", "method": "Math.SubtractNamed", "params": {"subtrahend": 23, "minuend": 42}, "id": 3}`,
+		`{"jsonrpc": "2.0", "result": 19, "id": 3}`,
+	},
+	{
+		"string id",
+		`{"jsonrpc": "2.0", "method": "Math.Subtract", "params": [23, 42], "id": "abc"}`,
+		`{"jsonrpc": "2.0", "result": -19, "id": "abc"}`,
+	},
+	{
+		"single positional parameter",
+		`{"jsonrpc": "2.0", "method": "Math.Double", "params": [21], "id": 4}`,
+		`{"jsonrpc": "2.0", "result": 42, "id": 4}`,
+	},
+	{
+		"non-existent method",
+		`{"jsonrpc": "2.0", "method": "foobar", "id": "1"}`,
+		`{"jsonrpc": "2.0", "error": {"code": -32601, "message": "No such function."}, "id": "1"}`,
+	},
+	{
+		"invalid request object",
+		`{"jsonrpc": "2.0", "method": 1, "params": "bar"}`,
+		`{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}`,
+	},
+	{
+		"empty array",
+		`[]`,
+		`{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}`,
+	},
+	{
+		"invalid batch",
+		`[1]`,
+		`[{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}]`,
+	},
+	{
+		"method error code",
+		`{"jsonrpc": "2.0", "method": "Math.Fail", "params": [], "id": 5}`,
+		`{"jsonrpc": "2.0", "error": {"code": 42, "message": "custom"}, "id": 5}`,
+	},
+	{
+		"method error without code",
+		`{"jsonrpc": "2.0", "method": "Math.Subtract", "params": [1], "id": 6}`,
+		`{"jsonrpc": "2.0", "error": {"code": -32000, "message": "need two numbers"}, "id": 6}`,
+	},
+}
+
+func assertJSONEqual(t *testing.T, name string, got []byte, want string) {
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("%s: bad response %q: %v", name, got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatalf("%s: bad expectation: %v", name, err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("%s: wrong response:\n%s\n!=\n%s", name, got, want)
+	}
+}
+
+func TestSpecExamples(t *testing.T) {
+	c, server_err := serve(t)
+	defer c.Close()
+	r := bufio.NewReader(c)
+
+	for _, ex := range specExamples {
+		io.WriteString(c, ex.req+"\n")
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("%s: read failed: %v", ex.name, err)
+		}
+		assertJSONEqual(t, ex.name, line, ex.resp)
+	}
+
+	c.Close()
+	if err := <-server_err; err != io.EOF {
+		t.Fatalf("unexpected error from Serve: %v", err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	c, server_err := serve(t)
+	defer c.Close()
+
+	io.WriteString(c, `[
+		{"jsonrpc": "2.0", "method": "Math.Sum", "params": [1,2,4], "id": "1"},
+		{"jsonrpc": "2.0", "method": "Math.Update", "params": [7]},
+		{"jsonrpc": "2.0", "method": "Math.Subtract", "params": [42,23], "id": "2"},
+		{"foo": "boo"},
+		{"jsonrpc": "2.0", "method": "foo.get", "params": {"name": "myself"}, "id": "5"},
+		{"jsonrpc": "2.0", "method": "Math.Double", "params": [3], "id": "9"}
+	]`+"\n")
+
+	var got []json.RawMessage
+	if err := json.NewDecoder(c).Decode(&got); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	want := map[string]string{
+		`"1"`:  `{"jsonrpc": "2.0", "result": 7, "id": "1"}`,
+		`"2"`:  `{"jsonrpc": "2.0", "result": 19, "id": "2"}`,
+		`null`: `{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}`,
+		`"5"`:  `{"jsonrpc": "2.0", "error": {"code": -32601, "message": "No such function."}, "id": "5"}`,
+		`"9"`:  `{"jsonrpc": "2.0", "result": 6, "id": "9"}`,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("wrong number of responses: %s", got)
+	}
+	for _, resp := range got {
+		var id struct{ ID json.RawMessage }
+		json.Unmarshal(resp, &id)
+		assertJSONEqual(t, string(id.ID), resp, want[string(id.ID)])
+	}
+
+	c.Close()
+	if err := <-server_err; err != io.EOF {
+		t.Fatalf("unexpected error from Serve: %v", err)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	c, server_err := serve(t)
+	defer c.Close()
+
+	io.WriteString(c, `{"jsonrpc": "2.0", "method": "Math.Update", "params": [1,2,3,4,5]}`+"\n")
+	io.WriteString(c, `{"jsonrpc": "2.0", "method": "Math.Update", "params": [1], "id": null}`+"\n")
+	io.WriteString(c, `[{"jsonrpc": "2.0", "method": "Math.Update", "params": [1]}]`+"\n")
+	io.WriteString(c, `{"jsonrpc": "2.0", "method": "Math.Sum", "params": [1], "id": 7}`+"\n")
+
+	// only the last one is answered
+	line, err := bufio.NewReader(c).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	assertJSONEqual(t, "notification", line, `{"jsonrpc": "2.0", "result": 1, "id": 7}`)
+
+	c.Close()
+	if err := <-server_err; err != io.EOF {
+		t.Fatalf("unexpected error from Serve: %v", err)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	c, server_err := serve(t)
+	defer c.Close()
+
+	io.WriteString(c, `{"jsonrpc": "2.0", "method": "foobar, "params": "bar", "baz]`+"\n")
+	line, err := bufio.NewReader(c).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	assertJSONEqual(t, "parse error", line, `{"jsonrpc": "2.0", "error": {"code": -32700, "message": "Parse error"}, "id": null}`)
+
+	// a stream can't recover from that
+	var syntax *json.SyntaxError
+	if err := <-server_err; !errors.As(err, &syntax) {
+		t.Fatalf("unexpected error from Serve: %v", err)
+	}
+}
+
+func TestBothDirections(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	server := birpc.NewEndpoint(jsonrpc2.NewCodec(s), makeRegistry())
+	server_err := make(chan error, 1)
+	go func() {
+		server_err <- server.Serve()
+	}()
+	client := birpc.NewEndpoint(jsonrpc2.NewCodec(c), makeRegistry())
+	client_err := make(chan error, 1)
+	go func() {
+		client_err <- client.Serve()
+	}()
+
+	var reply int
+	if err := client.Call("Math.Subtract", []int{42, 23}, &reply); err != nil {
+		t.Fatalf("client call failed: %v", err)
+	}
+	if reply != 19 {
+		t.Errorf("wrong answer: %d", reply)
+	}
+
+	// a scalar is wrapped as a single positional parameter
+	if err := server.Call("Math.Double", 21, &reply); err != nil {
+		t.Fatalf("server call failed: %v", err)
+	}
+	if reply != 42 {
+		t.Errorf("wrong answer: %d", reply)
+	}
+
+	err := client.Call("Math.Nope", nil, &reply)
+	if _, ok := err.(rpc.ServerError); !ok {
+		t.Errorf("expected a server error, got %v", err)
+	}
+
+	c.Close()
+	<-server_err
+	<-client_err
+}
+
+func TestWebSocketResync(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ws, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		endpoint := birpc.NewEndpoint(jsonrpc2.NewWebSocketCodec(ws), makeRegistry())
+		endpoint.Serve()
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "method"`))
+	_, buf, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	assertJSONEqual(t, "parse error", buf, `{"jsonrpc": "2.0", "error": {"code": -32700, "message": "Parse error"}, "id": null}`)
+
+	// the next message still works
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "method": "Math.Sum", "params": [2, 3], "id": 1}`))
+	_, buf, err = ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	assertJSONEqual(t, "after resync", buf, `{"jsonrpc": "2.0", "result": 5, "id": 1}`)
+}
+
+func TestNoChannels(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	e := birpc.NewEndpoint(jsonrpc2.NewCodec(s), nil)
+	if _, err := e.OpenChannel("admin", nil); err != birpc.ErrNoChannels {
+		t.Errorf("expected ErrNoChannels: %v", err)
+	}
+}
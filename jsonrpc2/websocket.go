@@ -0,0 +1,77 @@
+package jsonrpc2
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/gorilla/websocket"
+)
+
+type wsTransport struct {
+	WS *websocket.Conn
+}
+
+func (t *wsTransport) read() (json.RawMessage, error) {
+	_, buf, err := t.WS.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	var raw json.RawMessage
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// Every WebSocket message is parsed on its own, so one bad message
+// doesn't affect the rest.
+func (t *wsTransport) resync() bool { return true }
+
+func (t *wsTransport) write(buf []byte) error {
+	return t.WS.WriteMessage(websocket.TextMessage, buf)
+}
+
+func (t *wsTransport) ping() error {
+	return t.WS.WriteMessage(websocket.PingMessage, []byte{})
+}
+
+func (t *wsTransport) pong() error {
+	return t.WS.WriteMessage(websocket.PongMessage, []byte{})
+}
+
+func (t *wsTransport) setPingHandler(handler func(string) error) {
+	t.WS.SetPingHandler(handler)
+}
+
+func (t *wsTransport) setPongHandler(handler func(string) error) {
+	t.WS.SetPongHandler(handler)
+}
+
+func (t *wsTransport) Close() error {
+	return t.WS.Close()
+}
+
+type wsCodec struct {
+	*codec
+	ws *websocket.Conn
+}
+
+func (c *wsCodec) FillArgs(arglist []reflect.Value) error {
+	for i := 0; i < len(arglist); i++ {
+		switch arglist[i].Interface().(type) {
+		case *websocket.Conn:
+			arglist[i] = reflect.ValueOf(c.ws)
+		}
+	}
+	return nil
+}
+
+// NewWebSocketCodec returns a JSON-RPC 2.0 codec that sends one JSON
+// value per WebSocket text message. Like wetsock, it fills
+// *websocket.Conn arguments of RPC methods.
+func NewWebSocketCodec(ws *websocket.Conn) *wsCodec {
+	return &wsCodec{
+		codec: newCodec(&wsTransport{WS: ws}),
+		ws:    ws,
+	}
+}
@@ -0,0 +1,109 @@
+package birpc
+
+import (
+	"net/rpc"
+)
+
+// OnConnect adds a function to run for every Endpoint using the
+// Registry, once it has started serving and, if it sends a hello, the
+// handshake is done, so Capabilities are known. It may call the peer.
+// Functions run in the order added, before those of the Endpoint.
+func (r *Registry) OnConnect(fn func(e *Endpoint)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onConnect = append(r.onConnect, fn)
+}
+
+// OnDisconnect adds a function to run for every Endpoint using the
+// Registry, when Serve is about to return err. Method calls have
+// finished by then, but the Session is still there. Functions run in
+// the order added, before those of the Endpoint.
+func (r *Registry) OnDisconnect(fn func(e *Endpoint, err error)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onDisconnect = append(r.onDisconnect, fn)
+}
+
+// OnConnect adds a function to run once e has started serving, see
+// Registry.OnConnect. Must be called before Serve.
+func (e *Endpoint) OnConnect(fn func(e *Endpoint)) {
+	e.lifecycle.Lock()
+	defer e.lifecycle.Unlock()
+	e.lifecycle.onConnect = append(e.lifecycle.onConnect, fn)
+}
+
+// OnDisconnect adds a function to run when Serve is about to return,
+// see Registry.OnDisconnect. Must be called before Serve.
+func (e *Endpoint) OnDisconnect(fn func(e *Endpoint, err error)) {
+	e.lifecycle.Lock()
+	defer e.lifecycle.Unlock()
+	e.lifecycle.onDisconnect = append(e.lifecycle.onDisconnect, fn)
+}
+
+// Done returns a channel that is closed when Serve has returned, and
+// everything about the connection has been cleaned up.
+func (e *Endpoint) Done() <-chan struct{} {
+	return e.lifecycle.done
+}
+
+// Err returns the error Serve returned, or nil while it is serving.
+func (e *Endpoint) Err() error {
+	e.lifecycle.Lock()
+	defer e.lifecycle.Unlock()
+	return e.lifecycle.err
+}
+
+// connected runs the OnConnect functions.
+func (e *Endpoint) connected() {
+	e.server.registry.mu.RLock()
+	hooks := append([]func(*Endpoint){}, e.server.registry.onConnect...)
+	e.server.registry.mu.RUnlock()
+	e.lifecycle.Lock()
+	hooks = append(hooks, e.lifecycle.onConnect...)
+	e.lifecycle.Unlock()
+
+	for _, fn := range hooks {
+		fn(e)
+	}
+}
+
+// finish cleans up after Serve, which is returning err.
+func (e *Endpoint) finish(err error) {
+	e.failPending()
+
+	e.server.registry.mu.RLock()
+	hooks := append([]func(*Endpoint, error){}, e.server.registry.onDisconnect...)
+	e.server.registry.mu.RUnlock()
+	e.lifecycle.Lock()
+	hooks = append(hooks, e.lifecycle.onDisconnect...)
+	e.lifecycle.Unlock()
+
+	for _, fn := range hooks {
+		fn(e, err)
+	}
+	e.session.clear()
+
+	e.lifecycle.Lock()
+	e.lifecycle.err = err
+	e.lifecycle.Unlock()
+	close(e.lifecycle.done)
+}
+
+// failPending completes the calls still waiting for a response, as
+// none will come.
+func (e *Endpoint) failPending() {
+	e.client.mutex.Lock()
+	pending := e.client.pending
+	e.client.pending = make(map[uint64]*pendingCall)
+	e.client.mutex.Unlock()
+
+	for _, p := range pending {
+		e.endSpan(p.span, rpc.ErrShutdown)
+		p.call.Error = rpc.ErrShutdown
+		// notify the caller, but never block
+		select {
+		case p.call.Done <- p.call:
+		default:
+		}
+	}
+}
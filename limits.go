@@ -0,0 +1,55 @@
+package birpc
+
+import (
+	"fmt"
+)
+
+// RequestError is returned by Codec.ReadMessage for a request that
+// was read but can't be served, for example because it is too
+// large. Serve answers it with Err and keeps reading.
+type RequestError struct {
+	ID   uint64
+	Func string
+	Err  *Error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("birpc: bad request %d for %q: %s", e.ID, e.Func, e.Err.Msg)
+}
+
+// EncodeError is returned by Codec.WriteMessage when the args or
+// result of the message can't be encoded. Nothing has been written,
+// so the connection can still be used; a response is replaced with an
+// error.
+type EncodeError struct {
+	Err error
+}
+
+func (e *EncodeError) Error() string {
+	return "birpc: can't encode message: " + e.Err.Error()
+}
+
+func (e *EncodeError) Unwrap() error {
+	return e.Err
+}
+
+// MessageTooLargeError is returned by codecs for a message over their
+// size limit, when nothing can be answered. It ends the connection.
+type MessageTooLargeError struct {
+	Max int64
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("birpc: message larger than %d bytes", e.Max)
+}
+
+// MessageTooDeepError is returned by codecs for a message nested
+// deeper than their limit, when nothing can be answered. It ends the
+// connection.
+type MessageTooDeepError struct {
+	Max int
+}
+
+func (e *MessageTooDeepError) Error() string {
+	return fmt.Sprintf("birpc: message nested deeper than %d levels", e.Max)
+}
@@ -0,0 +1,58 @@
+package birpc
+
+// Logger receives structured events from birpc. The arguments after
+// msg are alternating keys and values, so a *slog.Logger from
+// log/slog can be used as is.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// nopLogger discards everything; it is the default.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// SetLogger makes the Registry, and every Endpoint using it that
+// has no Logger of its own, log to l. By default nothing is logged.
+func (r *Registry) SetLogger(l Logger) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logger = l
+}
+
+// getLogger returns the Logger of the Registry; r.mu must be held.
+func (r *Registry) getLogger() Logger {
+	if r.logger == nil {
+		return nopLogger{}
+	}
+	return r.logger
+}
+
+// SetLogger makes the Endpoint log to l instead of the Logger of its
+// Registry.
+//
+// Must be called before Serve.
+func (e *Endpoint) SetLogger(l Logger) {
+	e.logger = l
+}
+
+func (e *Endpoint) getLogger() Logger {
+	if e.logger != nil {
+		return e.logger
+	}
+	e.server.registry.mu.RLock()
+	defer e.server.registry.mu.RUnlock()
+	return e.server.registry.getLogger()
+}
+
+// Logger returns the Logger the Endpoint logs to, so code serving it
+// can log alongside; see SetLogger.
+func (e *Endpoint) Logger() Logger {
+	return e.getLogger()
+}
@@ -1,6 +1,8 @@
 package birpc
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 )
 
@@ -32,23 +34,97 @@ type Message struct {
 	// Information on how the call failed. Only valid for a
 	// response. Must be present if Result is omitted.
 	Error *Error `json:"error,omitempty"`
+
+	// Out-of-band data such as trace IDs or the client version,
+	// valid for both requests and responses.
+	Meta Metadata `json:"meta,omitempty"`
+
+	// Logical channel of the message, see Endpoint.OpenChannel.
+	// Empty for the main channel.
+	Channel string `json:"ch,omitempty"`
 }
 
+// Metadata is carried alongside the args or result of a call, see
+// WithMetadata and CallInfo.
+type Metadata map[string]string
+
 // Error is the on-wire description of an error that occurred while
 // serving the method call.
 type Error struct {
 	Msg string `json:"msg,omitempty"`
 
+	// Code classifies the error. Zero means unspecified. Codes
+	// defined by birpc use the JSON-RPC 2.0 numbering, see the
+	// Code constants.
+	//
+	// Code is only sent to peers that announced FeatureErrorCodes in
+	// their hello, or through an ErrorCoder; other peers get Msg
+	// alone.
+	Code int `json:"code,omitempty"`
+
 	// more fields may be added later
 
 	// TODO ponder about error detail, way for clients to tell
 	// transient/permanent, bad request vs out of memory
 }
 
+// Error codes set by birpc. They match the reserved codes of JSON-RPC
+// 2.0, so codecs for that protocol can pass them through unchanged.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+
+	// These are in the range JSON-RPC 2.0 leaves for
+	// implementations.
+	CodePermissionDenied = -32003
+	CodeRateLimited      = -32005
+	CodePeerNotFound     = -32006
+)
+
+// ErrorCoder is an optional interface that a Codec may implement, if
+// its wire format always carries error codes, like JSON-RPC 2.0.
+// Error.Code is then sent without waiting for the peer to negotiate
+// FeatureErrorCodes.
+type ErrorCoder interface {
+	CarriesErrorCodes() bool
+}
+
+// toError converts an error returned by a method into its on-wire
+// form. Methods can return an Error themselves to control the code.
+func toError(err error, code int) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	var ev Error
+	if errors.As(err, &ev) {
+		return &ev
+	}
+	return &Error{Msg: err.Error(), Code: code}
+}
+
+// UnmarshalJSON accepts a plain string as well as an object, as
+// legacy birpc.js peers send errors as strings.
+func (e *Error) UnmarshalJSON(data []byte) error {
+	var msg string
+	if err := json.Unmarshal(data, &msg); err == nil {
+		*e = Error{Msg: msg}
+		return nil
+	}
+	type plain Error
+	return json.Unmarshal(data, (*plain)(e))
+}
+
 func (e Error) Error() string {
 	return e.Msg
 }
 
 func (e Error) GoString() string {
+	if e.Code != 0 {
+		return fmt.Sprintf("%T{Msg: %q, Code: %d}", e, e.Msg, e.Code)
+	}
 	return fmt.Sprintf("%T{Msg: %q}", e, e.Msg)
 }
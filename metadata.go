@@ -0,0 +1,95 @@
+package birpc
+
+import (
+	"context"
+	"net/rpc"
+)
+
+// CallInfo describes an incoming call. RPC methods can get it by
+// taking a *CallInfo as an extra argument, or from their context with
+// CallInfoFromContext.
+type CallInfo struct {
+	// Method is the name of the function called, as SERVICE.METHOD.
+	Method string
+	// ID of the request, 0 if untagged.
+	ID uint64
+	// Meta is the metadata sent with the request. It may be nil.
+	Meta Metadata
+	// ResponseMeta is sent back with the response. Methods may add
+	// to it; it is never nil.
+	ResponseMeta Metadata
+}
+
+type callInfoKey struct{}
+
+// CallInfoFromContext returns the CallInfo of the call the context
+// was passed to, or nil.
+func CallInfoFromContext(ctx context.Context) *CallInfo {
+	info, _ := ctx.Value(callInfoKey{}).(*CallInfo)
+	return info
+}
+
+type metadataKey struct{}
+
+type responseMetadataKey struct{}
+
+type responseErrorKey struct{}
+
+// WithMetadata returns a context that makes CallContext send md with
+// the request. Metadata already in ctx is kept, with md taking
+// precedence.
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	merged := Metadata{}
+	for k, v := range MetadataFromContext(ctx) {
+		merged[k] = v
+	}
+	for k, v := range md {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, metadataKey{}, merged)
+}
+
+// MetadataFromContext returns the metadata set with WithMetadata, or
+// nil.
+func MetadataFromContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(metadataKey{}).(Metadata)
+	return md
+}
+
+// WithResponseMetadata returns a context that makes CallContext store
+// the metadata of the response in *md.
+func WithResponseMetadata(ctx context.Context, md *Metadata) context.Context {
+	return context.WithValue(ctx, responseMetadataKey{}, md)
+}
+
+// WithResponseError returns a context that makes CallContext store
+// the error the peer answers with in *rpcErr, Code included; the
+// error CallContext returns is an rpc.ServerError, like that of Call,
+// which only has the message. *rpcErr is left alone if the call
+// succeeds, or fails without an answer.
+func WithResponseError(ctx context.Context, rpcErr *Error) context.Context {
+	return context.WithValue(ctx, responseErrorKey{}, rpcErr)
+}
+
+// CallContext invokes the named function and waits for it to
+// complete, or for ctx to be done. Metadata set on ctx with
+// WithMetadata is sent with the request, and the call continues the
+// trace of ctx, see SpanContextFromContext. Metadata asked for with
+// WithResponseMetadata or WithResponseError is not written after
+// CallContext returns.
+func (e *Endpoint) CallContext(ctx context.Context, function string, args interface{}, reply interface{}) error {
+	msg := &Message{
+		Func: function,
+		Args: args,
+		Meta: MetadataFromContext(ctx),
+	}
+	call := e.start(ctx, msg, reply, make(chan *rpc.Call, 1))
+
+	select {
+	case <-ctx.Done():
+		e.forget(call, ctx.Err())
+		return ctx.Err()
+	case call := <-call.Done:
+		return call.Error
+	}
+}
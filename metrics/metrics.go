@@ -0,0 +1,255 @@
+// Package metrics collects measurements of birpc Endpoints and serves
+// them in the Prometheus text exposition format.
+//
+// Use it as the Collector of a Registry, and serve it over HTTP:
+//
+//	m := metrics.New()
+//	registry.SetCollector(m)
+//	http.Handle("/metrics", m)
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tv42/birpc"
+)
+
+// DefaultDurationBuckets are the upper bounds, in seconds, of the
+// buckets of the call duration and ping RTT histograms.
+var DefaultDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultSizeBuckets are the upper bounds, in bytes, of the buckets
+// of the message size histogram.
+var DefaultSizeBuckets = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576}
+
+type histogram struct {
+	bounds []float64
+	// counts[i] counts observations <= bounds[i]; the last one
+	// counts the rest
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+type methodStats struct {
+	started   uint64
+	succeeded uint64
+	// rejected by rate limits, before starting
+	rateLimited uint64
+	// failed calls by error code
+	failed   map[int]uint64
+	inFlight int64
+	duration *histogram
+}
+
+// Metrics is a birpc.Collector that keeps everything in memory.
+// It is safe for concurrent use.
+type Metrics struct {
+	mu      sync.Mutex
+	methods map[string]*methodStats
+	sizes   map[birpc.Direction]*histogram
+	pingRTT *histogram
+}
+
+var (
+	_ birpc.Collector       = (*Metrics)(nil)
+	_ birpc.RejectCollector = (*Metrics)(nil)
+)
+
+// New returns an empty Metrics.
+func New() *Metrics {
+	return &Metrics{
+		methods: make(map[string]*methodStats),
+		sizes: map[birpc.Direction]*histogram{
+			birpc.Inbound:  newHistogram(DefaultSizeBuckets),
+			birpc.Outbound: newHistogram(DefaultSizeBuckets),
+		},
+		pingRTT: newHistogram(DefaultDurationBuckets),
+	}
+}
+
+// method returns the stats of a method; m.mu must be held.
+func (m *Metrics) method(name string) *methodStats {
+	s := m.methods[name]
+	if s == nil {
+		s = &methodStats{
+			failed:   make(map[int]uint64),
+			duration: newHistogram(DefaultDurationBuckets),
+		}
+		m.methods[name] = s
+	}
+	return s
+}
+
+// CallStarted implements birpc.Collector.
+func (m *Metrics) CallStarted(method string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.method(method)
+	s.started++
+	s.inFlight++
+}
+
+// CallFinished implements birpc.Collector.
+func (m *Metrics) CallFinished(method string, err *birpc.Error, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.method(method)
+	s.inFlight--
+	if err == nil {
+		s.succeeded++
+	} else {
+		s.failed[err.Code]++
+	}
+	s.duration.observe(elapsed.Seconds())
+}
+
+// CallRejected implements birpc.RejectCollector.
+func (m *Metrics) CallRejected(method string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.method(method).rateLimited++
+}
+
+// MessageSize implements birpc.Collector.
+func (m *Metrics) MessageSize(dir birpc.Direction, size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sizes[dir].observe(float64(size))
+}
+
+// PingRTT implements birpc.Collector.
+func (m *Metrics) PingRTT(rtt time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pingRTT.observe(rtt.Seconds())
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	names := make([]string, 0, len(m.methods))
+	for name := range m.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	header(&b, "birpc_calls_started_total", "counter", "Incoming calls started.")
+	for _, name := range names {
+		sample(&b, "birpc_calls_started_total", labels("method", name), float64(m.methods[name].started))
+	}
+	header(&b, "birpc_calls_succeeded_total", "counter", "Incoming calls that succeeded.")
+	for _, name := range names {
+		sample(&b, "birpc_calls_succeeded_total", labels("method", name), float64(m.methods[name].succeeded))
+	}
+	header(&b, "birpc_calls_failed_total", "counter", "Incoming calls that failed, by error code.")
+	for _, name := range names {
+		failed := m.methods[name].failed
+		codes := make([]int, 0, len(failed))
+		for code := range failed {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			sample(&b, "birpc_calls_failed_total", labels("method", name, "code", strconv.Itoa(code)), float64(failed[code]))
+		}
+	}
+	header(&b, "birpc_calls_rate_limited_total", "counter", "Incoming calls rejected by rate limits.")
+	for _, name := range names {
+		sample(&b, "birpc_calls_rate_limited_total", labels("method", name), float64(m.methods[name].rateLimited))
+	}
+	header(&b, "birpc_calls_in_flight", "gauge", "Incoming calls being served.")
+	for _, name := range names {
+		sample(&b, "birpc_calls_in_flight", labels("method", name), float64(m.methods[name].inFlight))
+	}
+	header(&b, "birpc_call_duration_seconds", "histogram", "Time taken to serve incoming calls.")
+	for _, name := range names {
+		writeHistogram(&b, "birpc_call_duration_seconds", labels("method", name), m.methods[name].duration)
+	}
+	header(&b, "birpc_message_size_bytes", "histogram", "Encoded size of messages.")
+	for _, dir := range []birpc.Direction{birpc.Inbound, birpc.Outbound} {
+		writeHistogram(&b, "birpc_message_size_bytes", labels("direction", dir.String()), m.sizes[dir])
+	}
+	header(&b, "birpc_ping_rtt_seconds", "histogram", "Round trip time of pings.")
+	writeHistogram(&b, "birpc_ping_rtt_seconds", "", m.pingRTT)
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func header(b *strings.Builder, name, typ, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func sample(b *strings.Builder, name, labels string, v float64) {
+	fmt.Fprintf(b, "%s%s %s\n", name, labels, formatFloat(v))
+}
+
+func writeHistogram(b *strings.Builder, name, lbls string, h *histogram) {
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		sample(b, name+"_bucket", addLabel(lbls, "le", formatFloat(bound)), float64(cumulative))
+	}
+	sample(b, name+"_bucket", addLabel(lbls, "le", "+Inf"), float64(h.count))
+	sample(b, name+"_sum", lbls, h.sum)
+	sample(b, name+"_count", lbls, float64(h.count))
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats name, value pairs as a label set.
+func labels(pairs ...string) string {
+	var parts []string
+	for i := 0; i < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+`="`+labelEscaper.Replace(pairs[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// addLabel adds one label to a label set made by labels.
+func addLabel(set, name, value string) string {
+	l := labels(name, value)
+	if set == "" {
+		return l
+	}
+	return set[:len(set)-1] + "," + l[1:]
+}
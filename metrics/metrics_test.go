@@ -0,0 +1,100 @@
+package metrics_test
+
+import (
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tv42/birpc"
+	"github.com/tv42/birpc/jsonmsg"
+	"github.com/tv42/birpc/metrics"
+)
+
+type Arith struct{}
+
+func (Arith) Double(args int) (int, error) {
+	if args < 0 {
+		return 0, errors.New("negative")
+	}
+	return 2 * args, nil
+}
+
+func (Arith) Coded(args int) (int, error) {
+	return 0, &birpc.Error{Msg: "nope", Code: 7}
+}
+
+func TestMetrics(t *testing.T) {
+	m := metrics.New()
+	registry := birpc.NewRegistry()
+	registry.RegisterService(Arith{})
+	registry.SetCollector(m)
+	registry.LimitMethod("Arith.Coded", birpc.Limit{Rate: 0.001, Burst: 1})
+
+	c, s := net.Pipe()
+	defer c.Close()
+	server := birpc.NewEndpoint(jsonmsg.NewCodec(s), registry)
+	server_err := make(chan error, 1)
+	go func() {
+		server_err <- server.Serve()
+	}()
+	client := birpc.NewEndpoint(jsonmsg.NewCodec(c), nil)
+	client_err := make(chan error, 1)
+	go func() {
+		client_err <- client.Serve()
+	}()
+
+	var reply int
+	for _, n := range []int{1, 2, -1} {
+		client.Call("Arith.Double", n, &reply)
+	}
+	client.Call("Arith.Double", "not a number", &reply)
+	client.Call("Arith.Coded", 1, &reply)
+	client.Call("Arith.Coded", 1, &reply)
+	m.PingRTT(30 * time.Millisecond)
+
+	c.Close()
+	<-server_err
+	<-client_err
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	t.Logf("metrics:\n%s", body)
+
+	for _, want := range []string{
+		`# TYPE birpc_calls_started_total counter`,
+		`birpc_calls_started_total{method="Arith.Double"} 4`,
+		`birpc_calls_succeeded_total{method="Arith.Double"} 2`,
+		`birpc_calls_failed_total{method="Arith.Double",code="-32602"} 1`,
+		`birpc_calls_failed_total{method="Arith.Double",code="0"} 1`,
+		`birpc_calls_failed_total{method="Arith.Coded",code="7"} 1`,
+		`birpc_calls_rate_limited_total{method="Arith.Coded"} 1`,
+		`birpc_calls_rate_limited_total{method="Arith.Double"} 0`,
+		`birpc_calls_in_flight{method="Arith.Double"} 0`,
+		`# TYPE birpc_call_duration_seconds histogram`,
+		`birpc_call_duration_seconds_bucket{method="Arith.Double",le="+Inf"} 4`,
+		`birpc_call_duration_seconds_count{method="Arith.Coded"} 1`,
+		`birpc_message_size_bytes_count{direction="in"} 6`,
+		`birpc_message_size_bytes_count{direction="out"} 6`,
+		`birpc_ping_rtt_seconds_bucket{le="0.025"} 0`,
+		`birpc_ping_rtt_seconds_bucket{le="0.05"} 1`,
+		`birpc_ping_rtt_seconds_sum 0.03`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("missing %q", want)
+		}
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	m := metrics.New()
+	m.CallStarted("a\"b\\c\nd")
+	var b strings.Builder
+	m.WriteTo(&b)
+	if want := `birpc_calls_started_total{method="a\"b\\c\nd"} 1`; !strings.Contains(b.String(), want) {
+		t.Errorf("missing %q in:\n%s", want, b.String())
+	}
+}
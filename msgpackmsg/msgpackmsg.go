@@ -0,0 +1,139 @@
+// Package msgpackmsg is a birpc Codec that sends MessagePack instead
+// of JSON, over any io.ReadWriteCloser or as binary WebSocket
+// messages.
+//
+// Struct fields are named as encoding/json would name them: a msgpack
+// struct tag takes precedence, and a json tag is used otherwise. This
+// lets the same types be served over jsonmsg, wetsock and msgpackmsg.
+package msgpackmsg
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/tv42/birpc"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Args and Result stay encoded until UnmarshalArgs or
+// UnmarshalResult know what type to decode them into.
+type wireMessage struct {
+	ID      uint64             `msgpack:"id,omitempty"`
+	Func    string             `msgpack:"fn,omitempty"`
+	Args    msgpack.RawMessage `msgpack:"args,omitempty"`
+	Result  msgpack.RawMessage `msgpack:"result,omitempty"`
+	Error   *birpc.Error       `msgpack:"error,omitempty"`
+	Meta    birpc.Metadata     `msgpack:"meta,omitempty"`
+	Channel string             `msgpack:"ch,omitempty"`
+}
+
+func newDecoder(r io.Reader) *msgpack.Decoder {
+	dec := msgpack.NewDecoder(r)
+	dec.SetCustomStructTag("json")
+	return dec
+}
+
+func marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func unmarshal(raw []byte, v interface{}) error {
+	return newDecoder(bytes.NewReader(raw)).Decode(v)
+}
+
+func decodeMessage(dec *msgpack.Decoder, msg *birpc.Message) error {
+	var wm wireMessage
+	if err := dec.Decode(&wm); err != nil {
+		return err
+	}
+	msg.ID = wm.ID
+	msg.Func = wm.Func
+	msg.Args = wm.Args
+	msg.Result = wm.Result
+	msg.Error = wm.Error
+	msg.Meta = wm.Meta
+	msg.Channel = wm.Channel
+	return nil
+}
+
+func unmarshalArgs(msg *birpc.Message, args interface{}) error {
+	raw := msg.Args.(msgpack.RawMessage)
+	if raw == nil {
+		return nil
+	}
+	return unmarshal(raw, args)
+}
+
+func unmarshalResult(msg *birpc.Message, result interface{}) error {
+	raw := msg.Result.(msgpack.RawMessage)
+	if raw == nil {
+		return errors.New("birpc.msgpackmsg response must set result")
+	}
+	return unmarshal(raw, result)
+}
+
+type codec struct {
+	dec     *msgpack.Decoder
+	sending sync.Mutex
+	w       io.Writer
+	closer  io.Closer
+}
+
+func (c *codec) ReadMessage(msg *birpc.Message) error {
+	return decodeMessage(c.dec, msg)
+}
+
+func (c *codec) WriteMessage(msg *birpc.Message) error {
+	buf, err := marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	_, err = c.w.Write(buf)
+	return err
+}
+
+func (c *codec) Close() error {
+	return c.closer.Close()
+}
+
+func (c *codec) UnmarshalArgs(msg *birpc.Message, args interface{}) error {
+	return unmarshalArgs(msg, args)
+}
+
+func (c *codec) UnmarshalResult(msg *birpc.Message, result interface{}) error {
+	return unmarshalResult(msg, result)
+}
+
+func (c *codec) Ping() error {
+	return nil
+}
+
+func (c *codec) Pong() error {
+	return nil
+}
+
+func (c *codec) SetPingHandler(handler func(string) error) {}
+func (c *codec) SetPongHandler(handler func(string) error) {}
+
+// NewCodec returns a codec that sends a stream of MessagePack values
+// over conn. MessagePack values are self-delimiting, so no further
+// framing is needed.
+func NewCodec(conn io.ReadWriteCloser) *codec {
+	c := &codec{
+		dec:    newDecoder(conn),
+		w:      conn,
+		closer: conn,
+	}
+	return c
+}
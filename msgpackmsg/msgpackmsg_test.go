@@ -0,0 +1,154 @@
+package msgpackmsg_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/tv42/birpc"
+	"github.com/tv42/birpc/msgpackmsg"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type Request struct {
+	Word string `json:"word"`
+}
+
+type Reply struct {
+	Length int   `json:"length"`
+	Big    int64 `json:"big,omitempty"`
+}
+
+type WordLength struct{}
+
+func (_ WordLength) Len(request *Request, reply *Reply) error {
+	reply.Length = len(request.Word)
+	reply.Big = 1<<62 + 1
+	return nil
+}
+
+func makeRegistry() *birpc.Registry {
+	r := birpc.NewRegistry()
+	r.RegisterService(WordLength{})
+	return r
+}
+
+func TestServerTags(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	server := birpc.NewEndpoint(msgpackmsg.NewCodec(s), makeRegistry())
+	server_err := make(chan error)
+	go func() {
+		server_err <- server.Serve()
+	}()
+
+	go func() {
+		buf, _ := msgpack.Marshal(map[string]interface{}{
+			"id":   42,
+			"fn":   "WordLength.Len",
+			"args": map[string]interface{}{"word": "saippuakauppias"},
+		})
+		c.Write(buf)
+	}()
+
+	var reply map[string]interface{}
+	if err := msgpack.NewDecoder(c).Decode(&reply); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	t.Logf("reply msg: %#v", reply)
+	if reply["error"] != nil {
+		t.Fatalf("unexpected error response: %v", reply["error"])
+	}
+	result, ok := reply["result"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("unexpected result: %#v", reply["result"])
+	}
+	if g, e := result["length"], int8(15); g != e {
+		t.Errorf("got wrong answer: %#v", g)
+	}
+
+	c.Close()
+
+	err := <-server_err
+	if err != io.EOF {
+		t.Fatalf("unexpected error from ServeCodec: %v", err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	server := birpc.NewEndpoint(msgpackmsg.NewCodec(s), makeRegistry())
+	go server.Serve()
+
+	client := birpc.NewEndpoint(msgpackmsg.NewCodec(c), nil)
+	go client.Serve()
+
+	reply := &Reply{}
+	if err := client.Call("WordLength.Len", &Request{"xyzzy"}, reply); err != nil {
+		t.Fatalf("unexpected error from call: %v", err)
+	}
+	if reply.Length != 5 {
+		t.Errorf("got wrong answer: %v", reply.Length)
+	}
+	if reply.Big != 1<<62+1 {
+		t.Errorf("lost int64 precision: %v", reply.Big)
+	}
+
+	err := client.Call("WordLength.Nope", &Request{}, reply)
+	if err == nil || err.Error() != "No such function." {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	registry := makeRegistry()
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ws, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		msgpackmsg.NewWebSocketEndpoint(registry, ws).Serve()
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	client := msgpackmsg.NewWebSocketEndpoint(nil, ws)
+	go client.Serve()
+	defer ws.Close()
+
+	reply := &Reply{}
+	if err := client.Call("WordLength.Len", &Request{"hello"}, reply); err != nil {
+		t.Fatalf("unexpected error from call: %v", err)
+	}
+	if reply.Length != 5 {
+		t.Errorf("got wrong answer: %v", reply.Length)
+	}
+}
+
+func TestMetaAndChannel(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	go msgpackmsg.NewCodec(c).WriteMessage(&birpc.Message{
+		ID:      1,
+		Func:    "Admin.Status",
+		Meta:    birpc.Metadata{"trace": "abc"},
+		Channel: "admin",
+	})
+	var msg birpc.Message
+	if err := msgpackmsg.NewCodec(s).ReadMessage(&msg); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if msg.Meta["trace"] != "abc" || msg.Channel != "admin" {
+		t.Errorf("lost meta or channel: %+v", msg)
+	}
+}
@@ -0,0 +1,42 @@
+package birpc
+
+// Principal identifies the authenticated peer of an Endpoint. RPC
+// methods can get it by taking a *Principal as an extra argument; it
+// is nil if the peer has not been authenticated.
+type Principal struct {
+	// Name identifies the peer, for example a user name.
+	Name string
+	// Roles are used by authorization policies.
+	Roles []string
+	// Attrs holds anything else the authenticator knows.
+	Attrs map[string]string
+}
+
+// HasRole reports whether p has the given role. A nil Principal has
+// no roles.
+func (p *Principal) HasRole(role string) bool {
+	if p == nil {
+		return false
+	}
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// SetPrincipal records who the peer is, typically right after
+// authenticating it.
+func (e *Endpoint) SetPrincipal(p *Principal) {
+	e.principal.Lock()
+	defer e.principal.Unlock()
+	e.principal.p = p
+}
+
+// Principal returns the authenticated peer, or nil.
+func (e *Endpoint) Principal() *Principal {
+	e.principal.Lock()
+	defer e.principal.Unlock()
+	return e.principal.p
+}
@@ -0,0 +1,319 @@
+package protomsg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/tv42/birpc"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Field numbers of envelope.proto.
+const (
+	fieldID     protowire.Number = 1
+	fieldFunc   protowire.Number = 2
+	fieldArgs   protowire.Number = 3
+	fieldResult protowire.Number = 4
+	fieldError  protowire.Number = 5
+	fieldMeta   protowire.Number = 6
+	fieldCh     protowire.Number = 7
+
+	fieldErrorMsg  protowire.Number = 1
+	fieldErrorCode protowire.Number = 2
+
+	// of the map entries of meta
+	fieldKey   protowire.Number = 1
+	fieldValue protowire.Number = 2
+)
+
+// rawMessage is a serialized args or result message, kept until
+// UnmarshalArgs or UnmarshalResult know its type.
+type rawMessage []byte
+
+// builtin reports whether v is the args or result of a function built
+// into birpc, birpc.hello or getMethods. They are not proto.Message
+// values, and are sent as a google.protobuf.Value holding their JSON
+// form.
+func builtin(v interface{}) bool {
+	switch v.(type) {
+	case birpc.Hello, *birpc.Hello, []string, *[]string:
+		return true
+	}
+	return false
+}
+
+func marshalBuiltin(v interface{}) ([]byte, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var value structpb.Value
+	if err := value.UnmarshalJSON(buf); err != nil {
+		return nil, err
+	}
+	return proto.Marshal(&value)
+}
+
+func unmarshalBuiltin(b []byte, v interface{}) error {
+	if len(b) == 0 {
+		return nil
+	}
+	var value structpb.Value
+	if err := proto.Unmarshal(b, &value); err != nil {
+		return err
+	}
+	buf, err := value.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+func marshalPayload(v interface{}) ([]byte, error) {
+	if builtin(v) {
+		return marshalBuiltin(v)
+	}
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case rawMessage:
+		return v, nil
+	case struct{}:
+		// methods without a reply; an empty message
+		return []byte{}, nil
+	case proto.Message:
+		return proto.Marshal(v)
+	}
+	return nil, fmt.Errorf("birpc.protomsg: %T is not a proto.Message", v)
+}
+
+func marshalEnvelope(msg *birpc.Message) ([]byte, error) {
+	args, err := marshalPayload(msg.Args)
+	if err != nil {
+		return nil, &birpc.EncodeError{Err: err}
+	}
+	result, err := marshalPayload(msg.Result)
+	if err != nil {
+		return nil, &birpc.EncodeError{Err: err}
+	}
+
+	var b []byte
+	if msg.ID != 0 {
+		b = protowire.AppendTag(b, fieldID, protowire.VarintType)
+		b = protowire.AppendVarint(b, msg.ID)
+	}
+	if msg.Func != "" {
+		b = protowire.AppendTag(b, fieldFunc, protowire.BytesType)
+		b = protowire.AppendString(b, msg.Func)
+	}
+	if len(args) > 0 {
+		b = protowire.AppendTag(b, fieldArgs, protowire.BytesType)
+		b = protowire.AppendBytes(b, args)
+	}
+	if len(result) > 0 {
+		b = protowire.AppendTag(b, fieldResult, protowire.BytesType)
+		b = protowire.AppendBytes(b, result)
+	}
+	if msg.Error != nil {
+		var e []byte
+		if msg.Error.Msg != "" {
+			e = protowire.AppendTag(e, fieldErrorMsg, protowire.BytesType)
+			e = protowire.AppendString(e, msg.Error.Msg)
+		}
+		if msg.Error.Code != 0 {
+			e = protowire.AppendTag(e, fieldErrorCode, protowire.VarintType)
+			e = protowire.AppendVarint(e, protowire.EncodeZigZag(int64(msg.Error.Code)))
+		}
+		b = protowire.AppendTag(b, fieldError, protowire.BytesType)
+		b = protowire.AppendBytes(b, e)
+	}
+	for k, v := range msg.Meta {
+		var entry []byte
+		entry = protowire.AppendTag(entry, fieldKey, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, fieldValue, protowire.BytesType)
+		entry = protowire.AppendString(entry, v)
+		b = protowire.AppendTag(b, fieldMeta, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	if msg.Channel != "" {
+		b = protowire.AppendTag(b, fieldCh, protowire.BytesType)
+		b = protowire.AppendString(b, msg.Channel)
+	}
+	return b, nil
+}
+
+func unmarshalError(b []byte) (*birpc.Error, error) {
+	e := &birpc.Error{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == fieldErrorMsg && typ == protowire.BytesType:
+			e.Msg, n = protowire.ConsumeString(b)
+		case num == fieldErrorCode && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			e.Code = int(protowire.DecodeZigZag(v))
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return e, nil
+}
+
+func unmarshalMetaEntry(b []byte) (key, value string, err error) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == fieldKey && typ == protowire.BytesType:
+			key, n = protowire.ConsumeString(b)
+		case num == fieldValue && typ == protowire.BytesType:
+			value, n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return key, value, nil
+}
+
+func unmarshalEnvelope(b []byte, msg *birpc.Message) error {
+	*msg = birpc.Message{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == fieldID && typ == protowire.VarintType:
+			msg.ID, n = protowire.ConsumeVarint(b)
+		case num == fieldFunc && typ == protowire.BytesType:
+			msg.Func, n = protowire.ConsumeString(b)
+		case num == fieldArgs && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			msg.Args = rawMessage(v)
+		case num == fieldResult && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			msg.Result = rawMessage(v)
+		case num == fieldError && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				var err error
+				msg.Error, err = unmarshalError(v)
+				if err != nil {
+					return err
+				}
+			}
+		case num == fieldMeta && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				key, value, err := unmarshalMetaEntry(v)
+				if err != nil {
+					return err
+				}
+				if msg.Meta == nil {
+					msg.Meta = birpc.Metadata{}
+				}
+				msg.Meta[key] = value
+			}
+		case num == fieldCh && typ == protowire.BytesType:
+			msg.Channel, n = protowire.ConsumeString(b)
+		default:
+			// unknown fields are skipped, for forward compatibility
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// peekEnvelope finds the id and function of the envelope in b, which
+// may be truncated or otherwise broken. Anything it can't find is
+// left zero.
+func peekEnvelope(b []byte) (id uint64, fn string) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return id, fn
+		}
+		b = b[n:]
+		switch {
+		case num == fieldID && typ == protowire.VarintType:
+			id, n = protowire.ConsumeVarint(b)
+		case num == fieldFunc && typ == protowire.BytesType:
+			fn, n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return id, fn
+		}
+		b = b[n:]
+	}
+	return id, fn
+}
+
+// badRequest returns the error for the envelope in b, which could not
+// be read because of err. The request is answered if its id and
+// function can be found; otherwise err ends the connection.
+func badRequest(b []byte, reason string, err error) error {
+	id, fn := peekEnvelope(b)
+	if id == 0 || fn == "" {
+		return err
+	}
+	return &birpc.RequestError{
+		ID:   id,
+		Func: fn,
+		Err:  &birpc.Error{Msg: reason, Code: birpc.CodeInvalidRequest},
+	}
+}
+
+func unmarshalPayload(raw interface{}, v interface{}) error {
+	b, _ := raw.(rawMessage)
+	if builtin(v) {
+		return unmarshalBuiltin(b, v)
+	}
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("birpc.protomsg: %T is not a proto.Message", v)
+	}
+	// proto3 can't tell an empty message from an absent one
+	return proto.Unmarshal(b, m)
+}
+
+func unmarshalArgs(msg *birpc.Message, args interface{}) error {
+	return unmarshalPayload(msg.Args, args)
+}
+
+func unmarshalResult(msg *birpc.Message, result interface{}) error {
+	if msg.Error != nil {
+		return errors.New("birpc.protomsg response has no result")
+	}
+	return unmarshalPayload(msg.Result, result)
+}
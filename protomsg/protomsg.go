@@ -0,0 +1,100 @@
+// Package protomsg is a birpc Codec using Protocol Buffers, over
+// length-delimited streams or as binary WebSocket messages.
+//
+// Each message is sent as the Envelope of envelope.proto. Args and
+// results must be proto.Message values; they are embedded in the
+// envelope as bytes, and only decoded by UnmarshalArgs and
+// UnmarshalResult, once the method's types are known. RPC methods
+// therefore look like
+//
+//	func (s *Service) Get(args *pb.GetRequest, reply *pb.GetReply) error
+//
+// The functions built into birpc, birpc.hello and getMethods, carry a
+// google.protobuf.Value holding the JSON form of their args and
+// results. A result that can't be encoded is answered with an error.
+//
+// On streams, each envelope is preceded by its length as a varint,
+// the same framing as protodelim and Java's writeDelimitedTo.
+package protomsg
+
+import (
+	"errors"
+	"io"
+
+	"github.com/tv42/birpc"
+	"github.com/tv42/birpc/framing"
+)
+
+// DefaultMaxMessageSize limits the size of a single envelope read
+// from a stream.
+const DefaultMaxMessageSize = framing.DefaultMaxFrameSize
+
+type codec struct {
+	r      *framing.Reader
+	w      *framing.Writer
+	closer io.Closer
+}
+
+func (c *codec) ReadMessage(msg *birpc.Message) error {
+	buf, err := c.r.ReadFrame()
+	var tooLarge *framing.FrameTooLargeError
+	if errors.As(err, &tooLarge) {
+		if !tooLarge.Skipped {
+			return err
+		}
+		// the stream is still in sync
+		return badRequest(tooLarge.Head, "Message too large.", err)
+	}
+	if err != nil {
+		return err
+	}
+	if err := unmarshalEnvelope(buf, msg); err != nil {
+		return badRequest(buf, "Invalid message.", err)
+	}
+	return nil
+}
+
+func (c *codec) WriteMessage(msg *birpc.Message) error {
+	buf, err := marshalEnvelope(msg)
+	if err != nil {
+		return err
+	}
+	return c.w.WriteFrame(buf)
+}
+
+func (c *codec) Close() error {
+	return c.closer.Close()
+}
+
+func (c *codec) UnmarshalArgs(msg *birpc.Message, args interface{}) error {
+	return unmarshalArgs(msg, args)
+}
+
+func (c *codec) UnmarshalResult(msg *birpc.Message, result interface{}) error {
+	return unmarshalResult(msg, result)
+}
+
+func (c *codec) Ping() error {
+	return nil
+}
+
+func (c *codec) Pong() error {
+	return nil
+}
+
+func (c *codec) SetPingHandler(handler func(string) error) {}
+func (c *codec) SetPongHandler(handler func(string) error) {}
+
+// NewCodec returns a codec that sends varint length-delimited
+// envelopes over conn. Envelopes over DefaultMaxMessageSize, and
+// envelopes that fail to decode, are answered with an error if their
+// id and function can be read; otherwise they end the connection, as
+// do envelopes more than framing.SkipSize bytes over the limit.
+func NewCodec(conn io.ReadWriteCloser) *codec {
+	c := &codec{
+		r:      framing.NewReader(conn, framing.Varint, DefaultMaxMessageSize),
+		w:      framing.NewWriter(conn, framing.Varint, DefaultMaxMessageSize),
+		closer: conn,
+	}
+	return c
+}
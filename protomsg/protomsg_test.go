@@ -0,0 +1,232 @@
+package protomsg_test
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/tv42/birpc"
+	"github.com/tv42/birpc/framing"
+	"github.com/tv42/birpc/protomsg"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type Words struct{}
+
+func (Words) Len(args *wrapperspb.StringValue, reply *wrapperspb.Int64Value) error {
+	reply.Value = int64(len(args.Value))
+	return nil
+}
+
+func (Words) Big(args *wrapperspb.Int64Value) (*wrapperspb.Int64Value, error) {
+	return wrapperspb.Int64(args.Value - 1), nil
+}
+
+func (Words) Fail(args *wrapperspb.StringValue) error {
+	return &birpc.Error{Msg: args.Value, Code: -7}
+}
+
+// Plain returns a result that is not a proto.Message.
+func (Words) Plain(args *wrapperspb.StringValue) (string, error) {
+	return args.Value, nil
+}
+
+func makeRegistry() *birpc.Registry {
+	r := birpc.NewRegistry()
+	r.RegisterService(Words{})
+	return r
+}
+
+func testCalls(t *testing.T, client *birpc.Endpoint) {
+	reply := &wrapperspb.Int64Value{}
+	if err := client.Call("Words.Len", wrapperspb.String("xyzzy"), reply); err != nil {
+		t.Fatalf("unexpected error from call: %v", err)
+	}
+	if reply.Value != 5 {
+		t.Errorf("got wrong answer: %v", reply.Value)
+	}
+
+	// exact beyond float64
+	if err := client.Call("Words.Big", wrapperspb.Int64(math.MaxInt64), reply); err != nil {
+		t.Fatalf("unexpected error from call: %v", err)
+	}
+	if reply.Value != math.MaxInt64-1 {
+		t.Errorf("lost int64 precision: %v", reply.Value)
+	}
+
+	// an empty message has no bytes at all
+	if err := client.Call("Words.Len", wrapperspb.String(""), reply); err != nil {
+		t.Fatalf("unexpected error from call: %v", err)
+	}
+	if reply.Value != 0 {
+		t.Errorf("got wrong answer: %v", reply.Value)
+	}
+
+	err := client.Call("Words.Fail", wrapperspb.String("intentional"), reply)
+	if err == nil || err.Error() != "intentional" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// the built-in functions don't use proto.Message
+	var methods []string
+	if err := client.Call("getMethods", nil, &methods); err != nil {
+		t.Fatalf("unexpected error from getMethods: %v", err)
+	}
+	sort.Strings(methods)
+	if strings.Join(methods, ",") != "Words.Big,Words.Fail,Words.Len,Words.Plain" {
+		t.Errorf("wrong methods: %v", methods)
+	}
+
+	// a result that can't be encoded is answered with an error
+	err = client.Call("Words.Plain", wrapperspb.String("x"), reply)
+	if err == nil || err.Error() != "Internal error." {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	server := birpc.NewEndpoint(protomsg.NewCodec(s), makeRegistry())
+	server_err := make(chan error)
+	go func() {
+		server_err <- server.Serve()
+	}()
+	client := birpc.NewEndpoint(protomsg.NewCodec(c), nil)
+	client.SetHello(birpc.DefaultHello())
+	go client.Serve()
+
+	<-client.HandshakeDone()
+	if caps := client.Capabilities(); caps.Version != birpc.ProtocolVersion || !caps.Has(birpc.FeatureErrorCodes) {
+		t.Fatalf("handshake failed: %+v", caps)
+	}
+	testCalls(t, client)
+
+	c.Close()
+	if err := <-server_err; err != io.EOF {
+		t.Fatalf("unexpected error from ServeCodec: %v", err)
+	}
+}
+
+// envelope encodes a request by hand, with args as given.
+func envelope(id uint64, fn string, args []byte) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, id)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, fn)
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	return append(b, args...)
+}
+
+func TestBadFrames(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	server := birpc.NewEndpoint(protomsg.NewCodec(s), makeRegistry())
+	server_err := make(chan error)
+	go func() {
+		server_err <- server.Serve()
+	}()
+
+	xyzzy, _ := proto.Marshal(wrapperspb.String("xyzzy"))
+	w := framing.NewWriter(c, framing.Varint, 2*protomsg.DefaultMaxMessageSize)
+	go func() {
+		// args claim more bytes than there are
+		w.WriteFrame(envelope(1, "Words.Len", []byte{100}))
+		w.WriteFrame(envelope(2, "Words.Len", protowire.AppendBytes(nil, make([]byte, protomsg.DefaultMaxMessageSize))))
+		w.WriteFrame(envelope(3, "Words.Len", protowire.AppendBytes(nil, xyzzy)))
+		// nothing to answer
+		w.WriteFrame([]byte{0xff})
+	}()
+
+	client := protomsg.NewCodec(c)
+	for _, id := range []uint64{1, 2} {
+		var msg birpc.Message
+		if err := client.ReadMessage(&msg); err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if msg.ID != id || msg.Error == nil {
+			t.Fatalf("expected an error for %d: %#v", id, msg)
+		}
+	}
+	var msg birpc.Message
+	if err := client.ReadMessage(&msg); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	reply := &wrapperspb.Int64Value{}
+	if err := client.UnmarshalResult(&msg, reply); err != nil || msg.ID != 3 || reply.Value != 5 {
+		t.Fatalf("got wrong answer: %#v %v %v", msg, reply, err)
+	}
+
+	if err := <-server_err; err == nil || err == io.EOF {
+		t.Fatalf("expected a decoding error from Serve: %v", err)
+	}
+}
+
+func TestHugeFrame(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	server := birpc.NewEndpoint(protomsg.NewCodec(s), makeRegistry())
+	server_err := make(chan error)
+	go func() {
+		server_err <- server.Serve()
+	}()
+
+	// far too large to skip; the rest never needs to be sent
+	go c.Write(protowire.AppendVarint(nil, math.MaxUint64))
+	var tooLarge *framing.FrameTooLargeError
+	if err := <-server_err; !errors.As(err, &tooLarge) || tooLarge.Skipped {
+		t.Fatalf("expected a FrameTooLargeError not skipped: %v", err)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	registry := makeRegistry()
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ws, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		protomsg.NewWebSocketEndpoint(registry, ws).Serve()
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	client := protomsg.NewWebSocketEndpoint(nil, ws)
+	go client.Serve()
+	defer ws.Close()
+
+	testCalls(t, client)
+}
+
+func TestMetaAndChannel(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	go protomsg.NewCodec(c).WriteMessage(&birpc.Message{
+		ID:      1,
+		Func:    "Admin.Status",
+		Meta:    birpc.Metadata{"trace": "abc"},
+		Channel: "admin",
+	})
+	var msg birpc.Message
+	if err := protomsg.NewCodec(s).ReadMessage(&msg); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if msg.Meta["trace"] != "abc" || msg.Channel != "admin" {
+		t.Errorf("lost meta or channel: %+v", msg)
+	}
+}
@@ -0,0 +1,228 @@
+// Package pubsub lets birpc peers subscribe to topics, and get
+// messages published to them pushed as untagged notifications.
+//
+// Topics are made of levels separated by slashes, like
+// "orders/123/status". Subscriptions are to filters, which may use
+// MQTT style wildcards: "+" matches exactly one level, and "#", only
+// allowed as the last level, matches any number of remaining levels.
+// So "orders/+/status" and "orders/#" both match the topic above.
+//
+// Serve a Broker by registering it, and publish from Go:
+//
+//	broker := pubsub.New()
+//	broker.Register(registry)
+//	...
+//	broker.Publish("orders/123/status", "shipped")
+//
+// Peers call PubSub.Subscribe and PubSub.Unsubscribe with a filter,
+// and receive calls to DeliveryMethod with a Delivery as argument. In
+// Go, that is:
+//
+//	registry.RegisterServiceWithName(pubsub.Receiver(func(d *pubsub.Delivery) {
+//		...
+//	}), "PubSub")
+//	client.Call("PubSub.Subscribe", "orders/#", nil)
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/tv42/birpc"
+)
+
+// DeliveryMethod is the function called on subscribers, with a
+// Delivery. Go subscribers can serve it with a Receiver.
+const DeliveryMethod = "PubSub.Deliver"
+
+// Delivery is a published message, as sent to a subscriber.
+type Delivery struct {
+	Topic string `json:"topic"`
+	// Filter is the subscription that matched. A subscriber with
+	// several matching subscriptions gets a Delivery for each.
+	Filter  string      `json:"filter"`
+	Payload interface{} `json:"payload"`
+}
+
+// ErrBadFilter is returned for malformed filters, and for topics
+// containing wildcards.
+var ErrBadFilter = errors.New("pubsub: bad topic filter")
+
+// Broker keeps track of subscriptions, and delivers published
+// messages. It is safe for concurrent use.
+type Broker struct {
+	// queues notifications for each subscriber
+	hub *birpc.Hub
+
+	mu   sync.Mutex
+	subs map[*birpc.Endpoint]map[string]struct{}
+}
+
+// New returns a Broker without subscriptions.
+func New() *Broker {
+	b := &Broker{
+		hub:  birpc.NewHub(),
+		subs: make(map[*birpc.Endpoint]map[string]struct{}),
+	}
+	// slow subscribers are disconnected by the hub
+	b.hub.OnRemove(b.drop)
+	return b
+}
+
+// SetQueueSize sets how many deliveries are queued for each
+// subscriber; see birpc.Hub.SetQueueSize.
+func (b *Broker) SetQueueSize(n int) {
+	b.hub.SetQueueSize(n)
+}
+
+// SetSlowPolicy sets what to do with subscribers that can't keep up;
+// see birpc.Hub.SetSlowPolicy.
+func (b *Broker) SetSlowPolicy(p birpc.SlowPolicy) {
+	b.hub.SetSlowPolicy(p)
+}
+
+// Register makes the PubSub service available through registry.
+func (b *Broker) Register(registry *birpc.Registry) error {
+	return registry.RegisterServiceWithName(&service{broker: b}, "PubSub")
+}
+
+// Subscribe subscribes e to filter, until it stops serving, or
+// unsubscribes. ctx must be canceled when e stops serving, like the
+// context of an RPC method.
+func (b *Broker) Subscribe(ctx context.Context, e *birpc.Endpoint, filter string) error {
+	if !validFilter(filter) {
+		return ErrBadFilter
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	filters, ok := b.subs[e]
+	if !ok {
+		filters = make(map[string]struct{})
+		b.subs[e] = filters
+		b.hub.Add(e)
+		go func() {
+			<-ctx.Done()
+			b.hub.Remove(e)
+		}()
+	}
+	filters[filter] = struct{}{}
+	return nil
+}
+
+// Unsubscribe removes the subscription of e to filter.
+func (b *Broker) Unsubscribe(e *birpc.Endpoint, filter string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs[e], filter)
+}
+
+// drop forgets all subscriptions of e.
+func (b *Broker) drop(e *birpc.Endpoint) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, e)
+}
+
+// Subscriptions returns the filters e is subscribed to.
+func (b *Broker) Subscriptions(e *birpc.Endpoint) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := make([]string, 0, len(b.subs[e]))
+	for filter := range b.subs[e] {
+		list = append(list, filter)
+	}
+	return list
+}
+
+// Publish delivers payload to the subscribers of topic, returning how
+// many deliveries were queued. It does not wait for them to be sent.
+func (b *Broker) Publish(topic string, payload interface{}) (int, error) {
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		return 0, ErrBadFilter
+	}
+	type delivery struct {
+		e *birpc.Endpoint
+		d *Delivery
+	}
+	var list []delivery
+	b.mu.Lock()
+	for e, filters := range b.subs {
+		for filter := range filters {
+			if match(filter, topic) {
+				list = append(list, delivery{e, &Delivery{Topic: topic, Filter: filter, Payload: payload}})
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	// outside the lock, as a slow subscriber may get dropped
+	for _, d := range list {
+		b.hub.Send(d.e, DeliveryMethod, d.d)
+	}
+	return len(list), nil
+}
+
+// validFilter reports whether filter is well formed.
+func validFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch {
+		case level == "#":
+			if i != len(levels)-1 {
+				return false
+			}
+		case level == "+":
+		case strings.ContainsAny(level, "+#"):
+			return false
+		}
+	}
+	return true
+}
+
+// match reports whether topic matches filter.
+func match(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if level != "+" && level != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// service is the RPC interface of a Broker.
+type service struct {
+	broker *Broker
+}
+
+type nothing struct{}
+
+func (s *service) Subscribe(ctx context.Context, filter string, _ *nothing, e *birpc.Endpoint) error {
+	return s.broker.Subscribe(ctx, e, filter)
+}
+
+func (s *service) Unsubscribe(filter string, _ *nothing, e *birpc.Endpoint) error {
+	s.broker.Unsubscribe(e, filter)
+	return nil
+}
+
+// Receiver is a service receiving deliveries, for subscribers written
+// in Go. Register it with the name "PubSub".
+type Receiver func(d *Delivery)
+
+func (r Receiver) Deliver(d *Delivery) error {
+	r(d)
+	return nil
+}
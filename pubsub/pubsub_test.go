@@ -0,0 +1,171 @@
+package pubsub_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tv42/birpc"
+	"github.com/tv42/birpc/jsonmsg"
+	"github.com/tv42/birpc/pubsub"
+)
+
+// connect serves a new peer with broker, returning the client side
+// and where its deliveries arrive.
+func connect(t *testing.T, broker *pubsub.Broker) (*birpc.Endpoint, chan *pubsub.Delivery, func()) {
+	server := birpc.NewRegistry()
+	if err := broker.Register(server); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	got := make(chan *pubsub.Delivery, 10)
+	client := birpc.NewRegistry()
+	client.RegisterServiceWithName(pubsub.Receiver(func(d *pubsub.Delivery) {
+		got <- d
+	}), "PubSub")
+
+	c, s := net.Pipe()
+	server_err := make(chan error, 1)
+	go func() {
+		server_err <- birpc.NewEndpoint(jsonmsg.NewCodec(s), server).Serve()
+	}()
+	e := birpc.NewEndpoint(jsonmsg.NewCodec(c), client)
+	go e.Serve()
+	t.Cleanup(func() { c.Close() })
+	return e, got, func() {
+		c.Close()
+		<-server_err
+	}
+}
+
+func expect(t *testing.T, got chan *pubsub.Delivery, topic, filter string) {
+	t.Helper()
+	select {
+	case d := <-got:
+		if d.Topic != topic || d.Filter != filter {
+			t.Errorf("got %s via %s, want %s via %s", d.Topic, d.Filter, topic, filter)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no delivery of %s", topic)
+	}
+}
+
+func expectNothing(t *testing.T, got chan *pubsub.Delivery) {
+	t.Helper()
+	select {
+	case d := <-got:
+		t.Errorf("unexpected delivery: %+v", d)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	broker := pubsub.New()
+	alice, aliceGot, _ := connect(t, broker)
+	bob, bobGot, _ := connect(t, broker)
+
+	if err := alice.Call("PubSub.Subscribe", "orders/+/status", nil); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if err := bob.Call("PubSub.Subscribe", "orders/#", nil); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if err := bob.Call("PubSub.Subscribe", "orders/#/x", nil); err == nil {
+		t.Fatal("bad filter accepted")
+	}
+
+	if n, err := broker.Publish("orders/123/status", "shipped"); err != nil || n != 2 {
+		t.Fatalf("publish: %d %v", n, err)
+	}
+	expect(t, aliceGot, "orders/123/status", "orders/+/status")
+	expect(t, bobGot, "orders/123/status", "orders/#")
+
+	broker.Publish("orders/123", map[string]int{"total": 7})
+	select {
+	case d := <-bobGot:
+		if m, ok := d.Payload.(map[string]interface{}); !ok || m["total"] != 7.0 {
+			t.Errorf("wrong payload: %#v", d.Payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery")
+	}
+	expectNothing(t, aliceGot)
+
+	if err := bob.Call("PubSub.Unsubscribe", "orders/#", nil); err != nil {
+		t.Fatalf("unsubscribe: %v", err)
+	}
+	broker.Publish("orders/1/status", nil)
+	expect(t, aliceGot, "orders/1/status", "orders/+/status")
+	expectNothing(t, bobGot)
+
+	if _, err := broker.Publish("orders/+", nil); err != pubsub.ErrBadFilter {
+		t.Errorf("wildcard topic published: %v", err)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	broker := pubsub.New()
+	carol, _, disconnect := connect(t, broker)
+	if err := carol.Call("PubSub.Subscribe", "#", nil); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	disconnect()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n, _ := broker.Publish("anything", nil)
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("subscription outlived the endpoint")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	broker := pubsub.New()
+	e, got, _ := connect(t, broker)
+	go func() {
+		for range got {
+		}
+	}()
+
+	for _, test := range []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"orders/123", "orders/123", true},
+		{"orders/123", "orders/124", false},
+		{"orders/+", "orders/123", true},
+		{"orders/+", "orders/123/status", false},
+		{"orders/+/status", "orders/123/status", true},
+		{"orders/#", "orders/123/status", true},
+		{"orders/#", "orders", true},
+		{"orders/#", "order", false},
+		{"#", "anything/at/all", true},
+		{"+/+", "a/b", true},
+		{"+", "a/b", false},
+		{"orders", "orders/123", false},
+	} {
+		if err := e.Call("PubSub.Subscribe", test.filter, nil); err != nil {
+			t.Fatalf("subscribe %q: %v", test.filter, err)
+		}
+		n, err := broker.Publish(test.topic, nil)
+		if err != nil {
+			t.Fatalf("publish %q: %v", test.topic, err)
+		}
+		if matched := n == 1; matched != test.want {
+			t.Errorf("%q matching %q: %v, want %v", test.filter, test.topic, matched, test.want)
+		}
+		if err := e.Call("PubSub.Unsubscribe", test.filter, nil); err != nil {
+			t.Fatalf("unsubscribe %q: %v", test.filter, err)
+		}
+	}
+
+	for _, filter := range []string{"", "orders/#/x", "orders/1+", "orders#"} {
+		if err := e.Call("PubSub.Subscribe", filter, nil); err == nil {
+			t.Errorf("bad filter %q accepted", filter)
+		}
+	}
+}
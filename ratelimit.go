@@ -0,0 +1,222 @@
+package birpc
+
+import (
+	"sync"
+	"time"
+)
+
+// Limit configures a token bucket: Rate calls per second on average,
+// with bursts of up to Burst calls.
+type Limit struct {
+	Rate  float64
+	Burst int
+	// Delay makes calls over the limit wait for their turn, instead
+	// of failing with CodeRateLimited. Other calls, and the
+	// connection, are not held up by the wait.
+	Delay bool
+}
+
+type tokenBucket struct {
+	limit Limit
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(l Limit) *tokenBucket {
+	return &tokenBucket{limit: l, tokens: float64(l.Burst)}
+}
+
+// refill adds the tokens earned since the last call; b.mu must be
+// held.
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+		if max := float64(b.limit.Burst); b.tokens > max {
+			b.tokens = max
+		}
+	}
+	b.last = now
+}
+
+// check returns how long a call must wait for a token, or false if it
+// is over the limit and may not wait; b.mu must be held.
+func (b *tokenBucket) check() (time.Duration, bool) {
+	if b.tokens >= 1 {
+		return 0, true
+	}
+	if !b.limit.Delay || b.limit.Rate <= 0 {
+		return 0, false
+	}
+	return time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second)), true
+}
+
+// full reports whether b has refilled completely, making it the same
+// as a new bucket.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	return b.tokens >= float64(b.limit.Burst)
+}
+
+// reserve takes a token from each of buckets, or from none of them if
+// any rejects the call. It returns how long to wait before using
+// them. Buckets must always be passed in the same order, as they are
+// locked together.
+func reserve(buckets []*tokenBucket, now time.Time) (time.Duration, bool) {
+	for _, b := range buckets {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+	}
+	var wait time.Duration
+	for _, b := range buckets {
+		b.refill(now)
+		d, ok := b.check()
+		if !ok {
+			return 0, false
+		}
+		if d > wait {
+			wait = d
+		}
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return wait, true
+}
+
+// RejectCollector is an optional interface for a Collector, to count
+// calls rejected by rate limits.
+type RejectCollector interface {
+	CallRejected(method string)
+}
+
+// SetRateLimit limits all incoming calls on this Endpoint.
+//
+// Must be called before Serve.
+func (e *Endpoint) SetRateLimit(l Limit) {
+	e.limits.all = newTokenBucket(l)
+}
+
+// LimitMethod limits calls to the methods matching pattern, see
+// Authorize for the syntax. Every Endpoint has buckets of its own.
+func (r *Registry) LimitMethod(pattern string, l Limit) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.methodLimits == nil {
+		r.methodLimits = make(map[string]Limit)
+	}
+	r.methodLimits[pattern] = l
+}
+
+// LimitPrincipal limits the calls of every authenticated peer, by
+// Principal name, over all Endpoints using this Registry.
+func (r *Registry) LimitPrincipal(l Limit) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.principalLimit = &l
+	r.principalBuckets = make(map[string]*tokenBucket)
+}
+
+// methodLimit returns the limit applying to method; r.mu must be held
+// for reading.
+func (r *Registry) methodLimit(method string) (string, Limit, bool) {
+	for _, pattern := range patterns(method) {
+		if l, ok := r.methodLimits[pattern]; ok {
+			return pattern, l, true
+		}
+	}
+	return "", Limit{}, false
+}
+
+// minPrune is the fewest principal buckets that are pruned.
+const minPrune = 64
+
+// principalBucket returns the bucket of p, or nil.
+func (r *Registry) principalBucket(p *Principal) *tokenBucket {
+	if p == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.principalLimit == nil {
+		return nil
+	}
+	b := r.principalBuckets[p.Name]
+	if b == nil {
+		if len(r.principalBuckets) >= r.principalPrune {
+			r.pruneBuckets()
+		}
+		b = newTokenBucket(*r.principalLimit)
+		r.principalBuckets[p.Name] = b
+	}
+	return b
+}
+
+// pruneBuckets forgets the principal buckets that have refilled, as
+// they would be created again as they are. It runs when the number of
+// buckets has doubled since the last time, so it costs little per
+// call. r.mu must be held.
+func (r *Registry) pruneBuckets() {
+	now := time.Now()
+	for name, b := range r.principalBuckets {
+		if b.full(now) {
+			delete(r.principalBuckets, name)
+		}
+	}
+	r.principalPrune = 2 * len(r.principalBuckets)
+	if r.principalPrune < minPrune {
+		r.principalPrune = minPrune
+	}
+}
+
+// rateLimit applies the rate limits to a call to method. It returns
+// how long the call must wait, or false if it must be rejected.
+func (e *Endpoint) rateLimit(method string) (time.Duration, bool) {
+	buckets := make([]*tokenBucket, 0, 3)
+	if e.limits.all != nil {
+		buckets = append(buckets, e.limits.all)
+	}
+
+	e.server.registry.mu.RLock()
+	pattern, l, ok := e.server.registry.methodLimit(method)
+	e.server.registry.mu.RUnlock()
+	if ok {
+		e.limits.mu.Lock()
+		if e.limits.methods == nil {
+			e.limits.methods = make(map[string]*tokenBucket)
+		}
+		// one bucket per pattern, as in "Chat.*"
+		b := e.limits.methods[pattern]
+		if b == nil {
+			b = newTokenBucket(l)
+			e.limits.methods[pattern] = b
+		}
+		e.limits.mu.Unlock()
+		buckets = append(buckets, b)
+	}
+
+	// shared with other Endpoints, so always last
+	if b := e.server.registry.principalBucket(e.Principal()); b != nil {
+		buckets = append(buckets, b)
+	}
+	return reserve(buckets, time.Now())
+}
+
+// delay waits for a delayed call's turn. It returns false if Serve
+// returns first, and the call must not run.
+func (e *Endpoint) delay(wait time.Duration) bool {
+	if wait <= 0 {
+		return true
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-e.ctx.Done():
+		return false
+	}
+}
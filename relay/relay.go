@@ -0,0 +1,196 @@
+// Package relay lets birpc peers call each other through the server,
+// addressing the target by an ID.
+//
+// Every peer served by a Relay has an ID. A peer calls Relay.Call with
+// a CallArgs, naming the target and the method to call on it; the
+// server forwards the call through the target's Endpoint and sends
+// the reply back:
+//
+//	r := relay.New(func(from, to, method string) error {
+//		...
+//	})
+//	r.Register(registry)
+//	...
+//	r.Serve(endpoint, id)
+//
+// Arguments and replies pass through the server decoded, so they must
+// survive a round trip through interface{} with the codecs in use.
+package relay
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tv42/birpc"
+)
+
+// AuthorizeFunc decides whether the peer with ID from may call method
+// on the peer with ID to. The error is sent to the caller.
+type AuthorizeFunc func(from, to, method string) error
+
+// CallArgs are the arguments of Relay.Call.
+type CallArgs struct {
+	// To is the ID of the target peer.
+	To   string      `json:"to"`
+	Fn   string      `json:"fn"`
+	Args interface{} `json:"args"`
+}
+
+// ErrDuplicateID is returned by Serve for an ID that is in use.
+var ErrDuplicateID = errors.New("relay: duplicate peer id")
+
+// Relay forwards calls between its peers.
+type Relay struct {
+	authorize AuthorizeFunc
+
+	mu      sync.Mutex
+	peers   map[string]*birpc.Endpoint
+	ids     map[*birpc.Endpoint]string
+	timeout time.Duration
+}
+
+// New returns a Relay without peers. Every relayed call is checked by
+// authorize; if it is nil, peers may call each other freely.
+func New(authorize AuthorizeFunc) *Relay {
+	return &Relay{
+		authorize: authorize,
+		peers:     make(map[string]*birpc.Endpoint),
+		ids:       make(map[*birpc.Endpoint]string),
+	}
+}
+
+// SetTimeout bounds how long a relayed call may take. Zero, the
+// default, waits until the caller or the target disconnects.
+func (r *Relay) SetTimeout(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.timeout = d
+}
+
+// Register makes the Relay service available through registry.
+func (r *Relay) Register(registry *birpc.Registry) error {
+	return registry.RegisterServiceWithName(&service{relay: r}, "Relay")
+}
+
+// Serve adds e to the Relay as id, serves it, and removes it when
+// Serve returns. An empty id is replaced by a random one.
+func (r *Relay) Serve(e *birpc.Endpoint, id string) error {
+	id, err := r.Add(e, id)
+	if err != nil {
+		return err
+	}
+	defer r.Remove(id)
+	return e.Serve()
+}
+
+// Add makes e reachable as id, returning the id. An empty id is
+// replaced by a random one.
+func (r *Relay) Add(e *birpc.Endpoint, id string) (string, error) {
+	if id == "" {
+		var buf [8]byte
+		if _, err := rand.Read(buf[:]); err != nil {
+			return "", err
+		}
+		id = hex.EncodeToString(buf[:])
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.peers[id]; ok {
+		return "", ErrDuplicateID
+	}
+	r.peers[id] = e
+	r.ids[e] = id
+	return id, nil
+}
+
+// Remove makes the peer with the given id unreachable.
+func (r *Relay) Remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.peers[id]; ok {
+		delete(r.ids, e)
+		delete(r.peers, id)
+	}
+}
+
+// ID returns the id of e, or "" if it is not in the Relay.
+func (r *Relay) ID(e *birpc.Endpoint) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ids[e]
+}
+
+// Peers returns the ids of all peers, sorted.
+func (r *Relay) Peers() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]string, 0, len(r.peers))
+	for id := range r.peers {
+		list = append(list, id)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// call forwards a call from the peer e.
+func (r *Relay) call(ctx context.Context, e *birpc.Endpoint, args *CallArgs, reply *interface{}) error {
+	r.mu.Lock()
+	from, known := r.ids[e]
+	target, found := r.peers[args.To]
+	timeout := r.timeout
+	r.mu.Unlock()
+
+	if !known {
+		return &birpc.Error{Msg: "relay: caller has no id", Code: birpc.CodePermissionDenied}
+	}
+	if !found {
+		return &birpc.Error{Msg: "relay: no such peer", Code: birpc.CodePeerNotFound}
+	}
+	if r.authorize != nil {
+		if err := r.authorize(from, args.To, args.Fn); err != nil {
+			return &birpc.Error{Msg: err.Error(), Code: birpc.CodePermissionDenied}
+		}
+	}
+	if timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var rpcErr birpc.Error
+	err := target.CallContext(birpc.WithResponseError(ctx, &rpcErr), args.Fn, args.Args, reply)
+	if _, ok := err.(rpc.ServerError); ok {
+		// the error of the target, passed on with its code
+		return &rpcErr
+	}
+	return err
+}
+
+// service is the RPC interface of a Relay.
+type service struct {
+	relay *Relay
+}
+
+type nothing struct{}
+
+// Call calls a method of another peer.
+func (s *service) Call(ctx context.Context, args *CallArgs, reply *interface{}, e *birpc.Endpoint) error {
+	return s.relay.call(ctx, e, args, reply)
+}
+
+// ID returns the id of the calling peer.
+func (s *service) ID(_ *nothing, reply *string, e *birpc.Endpoint) error {
+	*reply = s.relay.ID(e)
+	return nil
+}
+
+// Peers returns the ids of all peers.
+func (s *service) Peers(_ *nothing, reply *[]string) error {
+	*reply = s.relay.Peers()
+	return nil
+}
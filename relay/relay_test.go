@@ -0,0 +1,115 @@
+package relay_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+
+	"github.com/tv42/birpc"
+	"github.com/tv42/birpc/jsonmsg"
+	"github.com/tv42/birpc/relay"
+)
+
+type Greeter struct {
+	name string
+}
+
+func (g Greeter) Hello(from string) (string, error) {
+	return fmt.Sprintf("hello %s, this is %s", from, g.name), nil
+}
+
+// connect serves a peer with the given id, returning the client side.
+func connect(t *testing.T, r *relay.Relay, server *birpc.Registry, id string) *birpc.Endpoint {
+	client := birpc.NewRegistry()
+	client.RegisterService(Greeter{name: id})
+
+	c, s := net.Pipe()
+	t.Cleanup(func() { c.Close() })
+	e := birpc.NewEndpoint(jsonmsg.NewCodec(s), server)
+	if _, err := r.Add(e, id); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	go func() {
+		defer r.Remove(id)
+		e.Serve()
+	}()
+	peer := birpc.NewEndpoint(jsonmsg.NewCodec(c), client)
+	peer.SetHello(birpc.DefaultHello())
+	go peer.Serve()
+	<-peer.HandshakeDone()
+	return peer
+}
+
+func TestRelay(t *testing.T) {
+	r := relay.New(func(from, to, method string) error {
+		if from == "mallory" {
+			return errors.New("go away")
+		}
+		return nil
+	})
+	server := birpc.NewRegistry()
+	if err := r.Register(server); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	alice := connect(t, r, server, "alice")
+	connect(t, r, server, "bob")
+	mallory := connect(t, r, server, "mallory")
+
+	var id string
+	if err := alice.Call("Relay.ID", nil, &id); err != nil || id != "alice" {
+		t.Fatalf("wrong id: %q %v", id, err)
+	}
+	var peers []string
+	if err := alice.Call("Relay.Peers", nil, &peers); err != nil || strings.Join(peers, ",") != "alice,bob,mallory" {
+		t.Fatalf("wrong peers: %v %v", peers, err)
+	}
+
+	var reply string
+	err := alice.Call("Relay.Call", relay.CallArgs{To: "bob", Fn: "Greeter.Hello", Args: "alice"}, &reply)
+	if err != nil {
+		t.Fatalf("relayed call failed: %v", err)
+	}
+	if reply != "hello alice, this is bob" {
+		t.Errorf("wrong reply: %q", reply)
+	}
+
+	err = alice.Call("Relay.Call", relay.CallArgs{To: "carol", Fn: "Greeter.Hello", Args: "alice"}, &reply)
+	if err == nil || !strings.Contains(err.Error(), "no such peer") {
+		t.Errorf("expected no such peer: %v", err)
+	}
+	err = mallory.Call("Relay.Call", relay.CallArgs{To: "bob", Fn: "Greeter.Hello", Args: "mallory"}, &reply)
+	if err == nil || !strings.Contains(err.Error(), "go away") {
+		t.Errorf("expected denial: %v", err)
+	}
+	// the target's error is passed on, code included
+	var rpcErr birpc.Error
+	ctx := birpc.WithResponseError(context.Background(), &rpcErr)
+	err = alice.CallContext(ctx, "Relay.Call", relay.CallArgs{To: "bob", Fn: "Greeter.Missing"}, &reply)
+	if _, ok := err.(rpc.ServerError); !ok {
+		t.Errorf("expected a server error: %v", err)
+	}
+	if rpcErr.Code != birpc.CodeMethodNotFound || rpcErr.Msg != err.Error() {
+		t.Errorf("expected the target's error: %+v", rpcErr)
+	}
+}
+
+func TestDuplicateID(t *testing.T) {
+	r := relay.New(nil)
+	c, s := net.Pipe()
+	defer c.Close()
+	e := birpc.NewEndpoint(jsonmsg.NewCodec(s), nil)
+	if _, err := r.Add(e, "x"); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := r.Serve(birpc.NewEndpoint(jsonmsg.NewCodec(c), nil), "x"); err != relay.ErrDuplicateID {
+		t.Errorf("expected ErrDuplicateID: %v", err)
+	}
+	id, err := r.Add(birpc.NewEndpoint(jsonmsg.NewCodec(c), nil), "")
+	if err != nil || len(id) != 16 {
+		t.Errorf("bad random id: %q %v", id, err)
+	}
+}
@@ -0,0 +1,132 @@
+package birpc
+
+import (
+	"sync"
+)
+
+// Session holds values attached to an Endpoint, such as the state of
+// a logged in user. It is safe for concurrent use.
+//
+// When Serve returns, after all method calls have finished, the
+// values are removed and their cleanup functions run.
+type Session struct {
+	mu     sync.Mutex
+	values map[string]sessionValue
+}
+
+type sessionValue struct {
+	value   interface{}
+	cleanup func()
+}
+
+// Session returns the values attached to e.
+func (e *Endpoint) Session() *Session {
+	return &e.session
+}
+
+// Get returns the value stored under key.
+func (s *Session) Get(key string) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	return v.value, ok
+}
+
+// Set stores value under key. A value it replaces is cleaned up.
+func (s *Session) Set(key string, value interface{}) {
+	s.SetWithCleanup(key, value, nil)
+}
+
+// SetWithCleanup stores value under key, calling cleanup when it is
+// deleted, replaced, or the Endpoint stops serving.
+func (s *Session) SetWithCleanup(key string, value interface{}, cleanup func()) {
+	s.mu.Lock()
+	old := s.values[key]
+	if s.values == nil {
+		s.values = make(map[string]sessionValue)
+	}
+	s.values[key] = sessionValue{value: value, cleanup: cleanup}
+	s.mu.Unlock()
+
+	if old.cleanup != nil {
+		old.cleanup()
+	}
+}
+
+// Delete removes the value stored under key, cleaning it up.
+func (s *Session) Delete(key string) {
+	s.mu.Lock()
+	old, ok := s.values[key]
+	delete(s.values, key)
+	s.mu.Unlock()
+
+	if ok && old.cleanup != nil {
+		old.cleanup()
+	}
+}
+
+// Keys returns the keys that have values, in no particular order.
+func (s *Session) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.values))
+	for k := range s.values {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// clear removes all values, cleaning them up.
+func (s *Session) clear() {
+	s.mu.Lock()
+	values := s.values
+	s.values = nil
+	s.mu.Unlock()
+
+	for _, v := range values {
+		if v.cleanup != nil {
+			v.cleanup()
+		}
+	}
+}
+
+// SessionKey is a key for values of type T, to store and fetch them
+// without type assertions:
+//
+//	var userKey = birpc.NewSessionKey[*User]("user")
+//	...
+//	userKey.Set(e.Session(), user)
+//	user, ok := userKey.Get(e.Session())
+type SessionKey[T any] struct {
+	name string
+}
+
+// NewSessionKey returns a key storing values under name. Keys with
+// the same name refer to the same value.
+func NewSessionKey[T any](name string) SessionKey[T] {
+	return SessionKey[T]{name: name}
+}
+
+// Get returns the value of k, or the zero value if there is none, or
+// it is not a T.
+func (k SessionKey[T]) Get(s *Session) (T, bool) {
+	v, ok := s.Get(k.name)
+	t, isT := v.(T)
+	return t, ok && isT
+}
+
+// Set stores value as k.
+func (k SessionKey[T]) Set(s *Session, value T) {
+	s.Set(k.name, value)
+}
+
+// SetWithCleanup stores value as k, calling cleanup with it when it
+// goes away; see Session.SetWithCleanup.
+func (k SessionKey[T]) SetWithCleanup(s *Session, value T, cleanup func(T)) {
+	s.SetWithCleanup(k.name, value, func() { cleanup(value) })
+}
+
+// Delete removes the value of k.
+func (k SessionKey[T]) Delete(s *Session) {
+	s.Delete(k.name)
+}
@@ -0,0 +1,65 @@
+package birpc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Timeouts bound how long codecs wait for the peer. Zero means no
+// limit.
+type Timeouts struct {
+	// Idle is how long to wait for the next message to start.
+	Idle time.Duration
+	// Read is how long to wait for the rest of a message, once it
+	// has started.
+	Read time.Duration
+	// Write is how long a write may take.
+	Write time.Duration
+}
+
+// TimeoutError is returned by codecs, and so by Serve, when the peer
+// took longer than allowed by Timeouts.
+type TimeoutError struct {
+	// Op is "idle", "read" or "write".
+	Op      string
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("birpc: %s timeout after %v", e.Op, e.Timeout)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Deadline returns the deadline for something starting now that may
+// take d, or the zero time if d is zero.
+func (t Timeouts) Deadline(d time.Duration) time.Time {
+	if d == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+// Check returns a *TimeoutError for op if err is a timeout, and err
+// otherwise.
+func (t Timeouts) Check(err error, op string) error {
+	var netErr net.Error
+	if err == nil || !errors.As(err, &netErr) || !netErr.Timeout() {
+		return err
+	}
+	var d time.Duration
+	switch op {
+	case "idle":
+		d = t.Idle
+	case "read":
+		d = t.Read
+	case "write":
+		d = t.Write
+	}
+	return &TimeoutError{Op: op, Timeout: d, Err: err}
+}
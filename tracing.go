@@ -0,0 +1,245 @@
+package birpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentKey is the metadata key used to propagate trace context,
+// in the format of the W3C Trace Context traceparent header.
+const TraceparentKey = "traceparent"
+
+// TraceID identifies a trace, that is all the spans caused by one
+// operation.
+type TraceID [16]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// SpanContext is the part of a span that is propagated to the peer.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid reports whether sc has a trace and span ID.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats sc as a traceparent value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+var errBadTraceparent = errors.New("birpc: malformed traceparent")
+
+// ParseTraceparent parses a traceparent value of version 00.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(s, "-")
+	if len(parts) != 4 || parts[0] != "00" ||
+		len(parts[1]) != 2*len(sc.TraceID) ||
+		len(parts[2]) != 2*len(sc.SpanID) ||
+		len(parts[3]) != 2 {
+		return sc, errBadTraceparent
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, errBadTraceparent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, errBadTraceparent
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, errBadTraceparent
+	}
+	sc.Sampled = flags[0]&1 != 0
+	if !sc.IsValid() {
+		return sc, errBadTraceparent
+	}
+	return sc, nil
+}
+
+// SpanKind tells which side of a call a span describes.
+type SpanKind int
+
+const (
+	// SpanServer is an incoming call, served by a registered method.
+	SpanServer SpanKind = iota
+	// SpanClient is an outgoing call.
+	SpanClient
+)
+
+func (k SpanKind) String() string {
+	if k == SpanClient {
+		return "client"
+	}
+	return "server"
+}
+
+// Span records one call.
+type Span struct {
+	SpanContext
+	// Parent is the span that caused this one, zero for the root
+	// of a trace.
+	Parent SpanID
+	Kind   SpanKind
+	// Method is the function called, as SERVICE.METHOD.
+	Method string
+	// ID of the request, 0 if untagged.
+	ID    uint64
+	Start time.Time
+	End   time.Time
+	// Error is the error message of a failed call, empty on
+	// success.
+	Error string
+}
+
+// Exporter receives spans once they end. ExportSpan may be called
+// concurrently.
+type Exporter interface {
+	ExportSpan(*Span)
+}
+
+// MemoryExporter keeps spans in memory. It is meant for tests.
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+// ExportSpan implements Exporter.
+func (m *MemoryExporter) ExportSpan(s *Span) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.spans = append(m.spans, *s)
+}
+
+// Spans returns the spans exported so far, in order of ending.
+func (m *MemoryExporter) Spans() []Span {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Span(nil), m.spans...)
+}
+
+// Reset forgets all spans.
+func (m *MemoryExporter) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.spans = nil
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns a context whose outgoing calls
+// continue the trace of sc.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context of ctx. Methods
+// taking a context.Context are given the span of their call.
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok
+}
+
+// SetExporter makes the Endpoint record spans for incoming and
+// outgoing calls. Without an exporter, trace context is still
+// propagated when the peer or the caller provides one.
+//
+// Must be called before Serve.
+func (e *Endpoint) SetExporter(exporter Exporter) {
+	e.exporter = exporter
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	rand.Read(id[:])
+	return id
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	rand.Read(id[:])
+	return id
+}
+
+// startSpan starts a span of the given kind under parent. It returns
+// nil if there is nothing to trace: no parent and no exporter.
+func (e *Endpoint) startSpan(kind SpanKind, method string, parent SpanContext, hasParent bool) *Span {
+	if !hasParent && e.exporter == nil {
+		return nil
+	}
+	s := &Span{
+		Kind:   kind,
+		Method: method,
+		Start:  time.Now(),
+	}
+	if hasParent {
+		s.TraceID = parent.TraceID
+		s.Parent = parent.SpanID
+		s.Sampled = parent.Sampled
+	} else {
+		s.TraceID = newTraceID()
+		s.Sampled = true
+	}
+	s.SpanID = newSpanID()
+	return s
+}
+
+// serverSpan starts the span of an incoming call, continuing the
+// trace sent by the peer, if any.
+func (e *Endpoint) serverSpan(info *CallInfo) *Span {
+	parent, err := ParseTraceparent(info.Meta[TraceparentKey])
+	s := e.startSpan(SpanServer, info.Method, parent, err == nil)
+	if s != nil {
+		s.ID = info.ID
+	}
+	return s
+}
+
+// clientSpan starts the span of an outgoing call, and adds its
+// traceparent to the metadata of msg.
+func (e *Endpoint) clientSpan(ctx context.Context, msg *Message) *Span {
+	parent, ok := SpanContextFromContext(ctx)
+	s := e.startSpan(SpanClient, msg.Func, parent, ok && parent.IsValid())
+	if s == nil {
+		return nil
+	}
+	meta := Metadata{}
+	for k, v := range msg.Meta {
+		meta[k] = v
+	}
+	meta[TraceparentKey] = s.Traceparent()
+	msg.Meta = meta
+	return s
+}
+
+// endSpan ends s and exports it. s may be nil.
+func (e *Endpoint) endSpan(s *Span, err error) {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	if err != nil {
+		s.Error = err.Error()
+	}
+	if e.exporter != nil && s.Sampled {
+		e.exporter.ExportSpan(s)
+	}
+}
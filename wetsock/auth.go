@@ -0,0 +1,275 @@
+package wetsock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tv42/birpc"
+)
+
+// ErrNoCredentials is returned by an Authenticator when the request
+// carries none of the credentials it looks for, as opposed to
+// carrying bad ones.
+var ErrNoCredentials = errors.New("wetsock: no credentials")
+
+// Authenticator decides who the peer is, from the HTTP request that
+// is about to be upgraded.
+type Authenticator interface {
+	Authenticate(req *http.Request) (*birpc.Principal, error)
+}
+
+// AuthenticatorFunc adapts a function to an Authenticator.
+type AuthenticatorFunc func(req *http.Request) (*birpc.Principal, error)
+
+func (f AuthenticatorFunc) Authenticate(req *http.Request) (*birpc.Principal, error) {
+	return f(req)
+}
+
+// VerifyFunc checks a token, returning the Principal it belongs to.
+type VerifyFunc func(token string) (*birpc.Principal, error)
+
+// Cookie authenticates with the value of the named cookie.
+func Cookie(name string, verify VerifyFunc) Authenticator {
+	return AuthenticatorFunc(func(req *http.Request) (*birpc.Principal, error) {
+		c, err := req.Cookie(name)
+		if err != nil || c.Value == "" {
+			return nil, ErrNoCredentials
+		}
+		return verify(c.Value)
+	})
+}
+
+// Bearer authenticates with an "Authorization: Bearer" header.
+func Bearer(verify VerifyFunc) Authenticator {
+	return AuthenticatorFunc(func(req *http.Request) (*birpc.Principal, error) {
+		const prefix = "Bearer "
+		h := req.Header.Get("Authorization")
+		if len(h) <= len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+			return nil, ErrNoCredentials
+		}
+		return verify(h[len(prefix):])
+	})
+}
+
+// QueryToken authenticates with a URL query parameter. Browsers
+// can't set headers on WebSocket requests, so this is the usual way
+// to pass a token that isn't in a cookie.
+func QueryToken(param string, verify VerifyFunc) Authenticator {
+	return AuthenticatorFunc(func(req *http.Request) (*birpc.Principal, error) {
+		token := req.URL.Query().Get(param)
+		if token == "" {
+			return nil, ErrNoCredentials
+		}
+		return verify(token)
+	})
+}
+
+// FirstOf tries each Authenticator in turn, until one finds
+// credentials.
+func FirstOf(auths ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(req *http.Request) (*birpc.Principal, error) {
+		for _, a := range auths {
+			p, err := a.Authenticate(req)
+			if err != ErrNoCredentials {
+				return p, err
+			}
+		}
+		return nil, ErrNoCredentials
+	})
+}
+
+// LoginMethod is the function a peer must call first, when
+// Server.Login is used.
+const LoginMethod = "birpc.login"
+
+// LoginFunc checks the arguments of a login call.
+type LoginFunc func(args json.RawMessage) (*birpc.Principal, error)
+
+// DefaultLoginTimeout is how long Server waits for the login call.
+const DefaultLoginTimeout = 10 * time.Second
+
+// Server is an http.Handler that authenticates the peer, upgrades the
+// connection and serves RPCs on it. The Principal is set on the
+// Endpoint, see birpc.Endpoint.SetPrincipal.
+type Server struct {
+	Registry *birpc.Registry
+	Upgrader websocket.Upgrader
+
+	// Authenticator checks the HTTP request. Requests with bad
+	// credentials are refused before upgrading. If nil, or if it
+	// returns ErrNoCredentials, Login is tried.
+	Authenticator Authenticator
+
+	// Login, if set, is used when the HTTP request had no
+	// credentials: the first call from the peer must then be to
+	// LoginMethod, though a hello may come before it. Its result is
+	// the name of the Principal. OnConnect functions may run before
+	// the login, and see no Principal.
+	Login        LoginFunc
+	LoginTimeout time.Duration
+
+	// Setup, if set, is called with every Endpoint before it is
+	// served, for example to set a Logger. The errors that end
+	// connections, such as failed logins, are logged to the Logger
+	// of the Endpoint, unless the peer just went away.
+	Setup func(*birpc.Endpoint)
+
+	// SetupCodec, if set, is called with the codec of every
+	// connection after Setup, for example to set limits, timeouts
+	// or compression. If it fails, the connection is closed.
+	SetupCodec func(Codec) error
+}
+
+// Codec is the birpc.Codec made by NewCodec, with its settings.
+type Codec interface {
+	birpc.Codec
+	SetLimits(maxSize int64, maxDepth int)
+	SetTimeouts(t birpc.Timeouts)
+	SetCompression(comp *Compression) error
+}
+
+var _ Codec = (*codec)(nil)
+
+// NewServer returns a Server that authenticates with auth.
+func NewServer(registry *birpc.Registry, auth Authenticator) *Server {
+	return &Server{
+		Registry:      registry,
+		Authenticator: auth,
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var principal *birpc.Principal
+	err := ErrNoCredentials
+	if s.Authenticator != nil {
+		principal, err = s.Authenticator.Authenticate(req)
+	}
+	switch {
+	case err == ErrNoCredentials && s.Login != nil:
+		// log in after upgrading
+	case err == ErrNoCredentials && s.Authenticator == nil:
+		// no authentication at all
+	case err != nil:
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ws, err := s.Upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// Upgrade already responded
+		return
+	}
+	codec := NewCodec(ws)
+	var e *birpc.Endpoint
+	if principal == nil && s.Login != nil {
+		lc := &loginCodec{codec: codec, server: s}
+		e = birpc.NewEndpoint(lc, s.Registry)
+		lc.endpoint = e
+	} else {
+		e = birpc.NewEndpoint(codec, s.Registry)
+	}
+	e.SetPrincipal(principal)
+	if s.Setup != nil {
+		s.Setup(e)
+	}
+	if s.SetupCodec != nil {
+		if err := s.SetupCodec(codec); err != nil {
+			e.Logger().Error("wetsock: codec setup failed", "remote", ws.RemoteAddr().String(), "err", err)
+			ws.Close()
+			return
+		}
+	}
+	err = e.Serve()
+	if err != io.EOF && !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+		e.Logger().Warn("wetsock: connection failed", "remote", ws.RemoteAddr().String(), "err", err)
+	}
+}
+
+var (
+	errNotLogin     = errors.New("wetsock: expected a login call")
+	errLoginTimeout = errors.New("wetsock: no login call in time")
+)
+
+// loginCodec holds back the calls of the peer until it has logged in.
+// Responses and hellos are let through, so the handshake can happen
+// first.
+type loginCodec struct {
+	*codec
+	server   *Server
+	endpoint *birpc.Endpoint
+
+	// only used by ReadMessage
+	loggedIn bool
+	timer    *time.Timer
+	expired  int32 // atomic
+}
+
+func (c *loginCodec) ReadMessage(msg *birpc.Message) error {
+	if c.loggedIn {
+		return c.codec.ReadMessage(msg)
+	}
+	if c.timer == nil {
+		timeout := c.server.LoginTimeout
+		if timeout == 0 {
+			timeout = DefaultLoginTimeout
+		}
+		c.timer = time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&c.expired, 1)
+			c.codec.Close()
+		})
+	}
+	if err := c.codec.ReadMessage(msg); err != nil {
+		if atomic.LoadInt32(&c.expired) != 0 {
+			return errLoginTimeout
+		}
+		return err
+	}
+	if msg.Func == "" || msg.Func == birpc.HelloMethod {
+		// the handshake needs no login
+		return nil
+	}
+	c.timer.Stop()
+	principal, err := c.login(msg)
+	if err != nil {
+		return err
+	}
+	c.endpoint.SetPrincipal(principal)
+	c.loggedIn = true
+	*msg = birpc.Message{}
+	return c.codec.ReadMessage(msg)
+}
+
+// login answers msg, which must be the login call, through the
+// Endpoint.
+func (c *loginCodec) login(msg *birpc.Message) (*birpc.Principal, error) {
+	if msg.Func != LoginMethod {
+		c.endpoint.Respond(msg.ID, nil, &birpc.Error{Msg: "Login required.", Code: birpc.CodeInvalidRequest})
+		return nil, errNotLogin
+	}
+
+	var args json.RawMessage
+	err := c.UnmarshalArgs(msg, &args)
+	var principal *birpc.Principal
+	if err == nil {
+		principal, err = c.server.Login(args)
+	}
+	if err == nil && principal == nil {
+		err = errors.New("no principal")
+	}
+	if err != nil {
+		// the reason is for our log, not for the peer
+		c.endpoint.Respond(msg.ID, nil, &birpc.Error{Msg: "Login failed.", Code: birpc.CodePermissionDenied})
+		return nil, fmt.Errorf("wetsock: login failed: %w", err)
+	}
+	if err := c.endpoint.Respond(msg.ID, principal.Name, nil); err != nil {
+		return nil, err
+	}
+	return principal, nil
+}
@@ -0,0 +1,54 @@
+package wetsock
+
+import (
+	"github.com/gorilla/websocket"
+)
+
+// Compression configures the permessage-deflate extension (RFC 7692).
+//
+// Compression is negotiated during the WebSocket handshake. Peers
+// that don't support it, or don't ask for it, keep talking
+// uncompressed, so it is safe to enable on a server with old clients.
+type Compression struct {
+	// Level is the compress/flate level to use, from 1 (fastest)
+	// to 9 (best). Zero uses the gorilla/websocket default.
+	Level int
+
+	// Threshold is the size in bytes of the smallest message that
+	// is compressed. Tiny messages often grow when compressed.
+	Threshold int
+}
+
+// NewUpgrader returns an Upgrader that offers compression to clients
+// if comp is not nil. Pass the same comp to SetCompression on the
+// codec.
+func NewUpgrader(comp *Compression) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		EnableCompression: comp != nil,
+	}
+}
+
+// NewDialer returns a Dialer that asks servers for compression if
+// comp is not nil. Pass the same comp to SetCompression on the codec.
+func NewDialer(comp *Compression) *websocket.Dialer {
+	d := *websocket.DefaultDialer
+	d.EnableCompression = comp != nil
+	return &d
+}
+
+// SetCompression controls compression of outgoing messages. With a
+// nil comp, every message is compressed if the handshake negotiated
+// compression, as gorilla/websocket does by default. It has no
+// effect if compression was not negotiated.
+func (c *codec) SetCompression(comp *Compression) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if comp != nil && comp.Level != 0 {
+		if err := c.WS.SetCompressionLevel(comp.Level); err != nil {
+			return err
+		}
+	}
+	c.compression = comp
+	return nil
+}
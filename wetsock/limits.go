@@ -0,0 +1,81 @@
+package wetsock
+
+import (
+	"io"
+
+	"github.com/gorilla/websocket"
+	"github.com/tv42/birpc"
+	"github.com/tv42/birpc/internal/jsonlimit"
+)
+
+// SetLimits bounds incoming messages to maxSize bytes, and their
+// arguments to maxDepth levels of nested arrays and objects. Zero
+// means no limit.
+//
+// A request over a limit is answered with an error when its id can be
+// read from it; otherwise ReadMessage returns a
+// *birpc.MessageTooLargeError or *birpc.MessageTooDeepError. The
+// requests of a batch are checked one by one. Messages more than
+// DrainSize bytes over maxSize are not read to the end: the
+// connection is closed instead. Must be called before Serve.
+func (c *codec) SetLimits(maxSize int64, maxDepth int) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	c.maxSize = maxSize
+	c.maxDepth = maxDepth
+	if maxSize > 0 {
+		c.WS.SetReadLimit(maxSize + DrainSize)
+	} else {
+		c.WS.SetReadLimit(0)
+	}
+}
+
+// DrainSize is how far over the size limit a message may go and
+// still be skipped, so the request can be answered and the connection
+// kept. Larger messages close the connection.
+const DrainSize = 1 << 20
+
+// read reads the next message, enforcing the size limit and timeouts;
+// c.readMu must be held.
+func (c *codec) read() ([]byte, error) {
+	timed := c.timeouts.Idle != 0 || c.timeouts.Read != 0
+	if timed {
+		c.WS.SetReadDeadline(c.timeouts.Deadline(c.timeouts.Idle))
+	}
+	_, r, err := c.WS.NextReader()
+	if err != nil {
+		return nil, c.readError(err, "idle")
+	}
+	if timed {
+		c.WS.SetReadDeadline(c.timeouts.Deadline(c.timeouts.Read))
+	}
+	if c.maxSize <= 0 {
+		buf, err := io.ReadAll(r)
+		if err != nil {
+			return nil, c.readError(err, "read")
+		}
+		return buf, nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(r, c.maxSize+1))
+	if err != nil {
+		return nil, c.readError(err, "read")
+	}
+	if int64(len(buf)) > c.maxSize {
+		// skip the rest without keeping it, to stay in sync; the
+		// read limit of the connection bounds how much that is
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return nil, c.readError(err, "read")
+		}
+		return nil, jsonlimit.TooLarge(buf, c.maxSize)
+	}
+	return buf, nil
+}
+
+// readError converts errors of the connection; op is as in
+// birpc.TimeoutError.
+func (c *codec) readError(err error, op string) error {
+	if err == websocket.ErrReadLimit {
+		return &birpc.MessageTooLargeError{Max: c.maxSize}
+	}
+	return c.timeouts.Check(err, op)
+}
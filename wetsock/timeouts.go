@@ -0,0 +1,24 @@
+package wetsock
+
+import (
+	"github.com/tv42/birpc"
+)
+
+// SetTimeouts bounds how long reads and writes wait for the peer.
+// Only messages count as activity for the idle timeout, not pings
+// and pongs. When a timeout expires, the connection is unusable and
+// Serve returns a *birpc.TimeoutError. Must be called before Serve.
+func (c *codec) SetTimeouts(t birpc.Timeouts) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.timeouts = t
+}
+
+// setWriteDeadline starts a write; c.writeMu must be held.
+func (c *codec) setWriteDeadline() {
+	if c.timeouts.Write != 0 {
+		c.WS.SetWriteDeadline(c.timeouts.Deadline(c.timeouts.Write))
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/tv42/birpc"
+	"github.com/tv42/birpc/internal/jsonlimit"
 )
 
 type codec struct {
@@ -16,6 +17,22 @@ type codec struct {
 	// As above document.Only one concurrent reader and one concurrent writer are allowed.
 	readMu  sync.Mutex
 	writeMu sync.Mutex
+
+	// protected by writeMu
+	compression *Compression
+
+	// set under both locks, so holding either is enough to read
+	sizeHandler func(birpc.Direction, int)
+
+	// rest of a batch, protected by readMu
+	queue []jsonMessage
+
+	// limits on incoming messages, protected by readMu
+	maxSize  int64
+	maxDepth int
+
+	// set under both locks, like sizeHandler
+	timeouts birpc.Timeouts
 }
 
 // This is ugly, but i need to override the unmarshaling logic for
@@ -24,42 +41,85 @@ type codec struct {
 // can embed birpc.Message and just override the two fields I need to
 // change.
 type jsonMessage struct {
-	ID     uint64          `json:"id"`
-	Func   string          `json:"fn,omitempty"`
-	Args   json.RawMessage `json:"args,omitempty"`
-	Result json.RawMessage `json:"result,omitempty"`
-	Error  *birpc.Error    `json:"error"`
+	ID      uint64          `json:"id"`
+	Func    string          `json:"fn,omitempty"`
+	Args    json.RawMessage `json:"args,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *birpc.Error    `json:"error"`
+	Meta    birpc.Metadata  `json:"meta,omitempty"`
+	Channel string          `json:"ch,omitempty"`
+
+	// returned by ReadMessage in place of the message
+	err error
 }
 
 func (c *codec) ReadMessage(msg *birpc.Message) error {
 	c.readMu.Lock()
 	defer c.readMu.Unlock()
 
-	var jm jsonMessage
-	err := c.WS.ReadJSON(&jm)
-	if err != nil {
-		return err
+	for len(c.queue) == 0 {
+		buf, err := c.read()
+		if err != nil {
+			return err
+		}
+		if c.sizeHandler != nil {
+			c.sizeHandler(birpc.Inbound, len(buf))
+		}
+		c.queue, err = unpack(buf, c.maxDepth)
+		if err != nil {
+			return err
+		}
+	}
+	jm := c.queue[0]
+	c.queue = c.queue[1:]
+	if jm.err != nil {
+		return jm.err
 	}
 	msg.ID = jm.ID
 	msg.Func = jm.Func
 	msg.Args = jm.Args
 	msg.Result = jm.Result
 	msg.Error = jm.Error
+	msg.Meta = jm.Meta
+	msg.Channel = jm.Channel
 	return nil
 }
 
+// unpack decodes a message, or a batch of messages sent as a JSON
+// array. Messages of a batch nested deeper than maxDepth are kept as
+// their error, so the others can still be served.
+func unpack(buf []byte, maxDepth int) ([]jsonMessage, error) {
+	msgs, errs, err := jsonlimit.Unpack(buf, maxDepth)
+	if err != nil {
+		return nil, err
+	}
+	batch := make([]jsonMessage, len(msgs))
+	for i, msg := range msgs {
+		if errs[i] != nil {
+			batch[i].err = errs[i]
+			continue
+		}
+		if err := json.Unmarshal(msg, &batch[i]); err != nil {
+			return nil, err
+		}
+	}
+	return batch, nil
+}
+
 func (c *codec) Ping() error {
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
 
-	return c.WS.WriteMessage(websocket.PingMessage, []byte{})
+	c.setWriteDeadline()
+	return c.timeouts.Check(c.WS.WriteMessage(websocket.PingMessage, []byte{}), "write")
 }
 
 func (c *codec) Pong() error {
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
 
-	return c.WS.WriteMessage(websocket.PongMessage, []byte{})
+	c.setWriteDeadline()
+	return c.timeouts.Check(c.WS.WriteMessage(websocket.PongMessage, []byte{}), "write")
 }
 
 func (c *codec) SetPingHandler(handler func(string) error) {
@@ -78,7 +138,48 @@ func (c *codec) WriteMessage(msg *birpc.Message) error {
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
 
-	return c.WS.WriteJSON(msg)
+	return c.write(msg)
+}
+
+// WriteBatch implements birpc.BatchWriter, sending the messages as
+// one JSON array in a single WebSocket message.
+func (c *codec) WriteBatch(msgs []*birpc.Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return c.write(msgs)
+}
+
+// write sends v as one text message; c.writeMu must be held.
+func (c *codec) write(v interface{}) error {
+	c.setWriteDeadline()
+	if c.compression == nil && c.sizeHandler == nil {
+		return c.timeouts.Check(c.WS.WriteJSON(v), "write")
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if c.compression != nil {
+		c.WS.EnableWriteCompression(len(buf) >= c.compression.Threshold)
+	}
+	if err := c.WS.WriteMessage(websocket.TextMessage, buf); err != nil {
+		return c.timeouts.Check(err, "write")
+	}
+	if c.sizeHandler != nil {
+		c.sizeHandler(birpc.Outbound, len(buf))
+	}
+	return nil
+}
+
+// SetSizeHandler implements birpc.SizeReporter. Sizes are before
+// compression.
+func (c *codec) SetSizeHandler(handler func(birpc.Direction, int)) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.sizeHandler = handler
 }
 
 func (c *codec) Close() error {
@@ -1,10 +1,13 @@
 package wetsock_test
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 
@@ -564,3 +567,521 @@ func TestServerNoArgs(t *testing.T) {
 	stoppableListener.Stop()
 	wg.Wait()
 }
+
+func TestCompression(t *testing.T) {
+	registry := birpc.NewRegistry()
+	registry.RegisterService(WordLength{})
+
+	comp := &wetsock.Compression{Level: 9, Threshold: 64}
+	upgrader := wetsock.NewUpgrader(comp)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ws, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		codec := wetsock.NewCodec(ws)
+		codec.SetCompression(comp)
+		birpc.NewEndpoint(codec, registry).Serve()
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	for _, dialComp := range []*wetsock.Compression{comp, nil} {
+		ws, resp, err := wetsock.NewDialer(dialComp).Dial(url, nil)
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		negotiated := strings.Contains(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+		if negotiated != (dialComp != nil) {
+			t.Errorf("compression negotiated=%v with client compression %v", negotiated, dialComp)
+		}
+
+		codec := wetsock.NewCodec(ws)
+		codec.SetCompression(dialComp)
+		client := birpc.NewEndpoint(codec, nil)
+		go client.Serve()
+
+		for _, word := range []string{"short", strings.Repeat("saippuakauppias", 100)} {
+			reply := &Reply{}
+			if err := client.Call("WordLength.Len", &Request{word}, reply); err != nil {
+				t.Fatalf("unexpected error from call: %v", err)
+			}
+			if reply.Length != len(word) {
+				t.Errorf("got wrong answer: %v", reply.Length)
+			}
+		}
+		ws.Close()
+	}
+}
+
+func TestBatch(t *testing.T) {
+	registry := birpc.NewRegistry()
+	registry.RegisterService(WordLength{})
+
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ws, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		wetsock.NewEndpoint(registry, ws).Serve()
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// like birpc.js, the batch is unpacked and answered one by one
+	ws.WriteMessage(websocket.TextMessage, []byte(`[
+		{"id": 1, "fn": "WordLength.Len", "args": {"Word": "a"}},
+		{"id": 2, "fn": "WordLength.Len", "args": {"Word": "bb"}}
+	]`))
+	got := map[uint64]int{}
+	for i := 0; i < 2; i++ {
+		var reply struct {
+			ID     uint64
+			Result Reply
+		}
+		if err := ws.ReadJSON(&reply); err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		got[reply.ID] = reply.Result.Length
+	}
+	if got[1] != 1 || got[2] != 2 {
+		t.Errorf("wrong answers: %v", got)
+	}
+}
+
+type Whoami struct{}
+
+func (Whoami) Name(args struct{}, reply *string, p *birpc.Principal) error {
+	if p == nil {
+		return errors.New("anonymous")
+	}
+	*reply = p.Name
+	return nil
+}
+
+func verifyToken(token string) (*birpc.Principal, error) {
+	if token != "sekrit" {
+		return nil, errors.New("bad token")
+	}
+	return &birpc.Principal{Name: "alice", Roles: []string{"admin"}}, nil
+}
+
+func whoami(t *testing.T, ws *websocket.Conn) string {
+	client := wetsock.NewEndpoint(nil, ws)
+	go client.Serve()
+	var name string
+	if err := client.Call("Whoami.Name", struct{}{}, &name); err != nil {
+		t.Fatalf("call failed: %v", err)
+	}
+	return name
+}
+
+func TestAuthenticator(t *testing.T) {
+	registry := birpc.NewRegistry()
+	registry.RegisterService(Whoami{})
+	auth := wetsock.FirstOf(
+		wetsock.Bearer(verifyToken),
+		wetsock.Cookie("session", verifyToken),
+		wetsock.QueryToken("token", verifyToken),
+	)
+	srv := httptest.NewServer(wetsock.NewServer(registry, auth))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	for _, test := range []struct {
+		name   string
+		url    string
+		header http.Header
+		status int
+	}{
+		{"bearer", url, http.Header{"Authorization": {"Bearer sekrit"}}, 0},
+		{"cookie", url, http.Header{"Cookie": {"session=sekrit"}}, 0},
+		{"query", url + "?token=sekrit", nil, 0},
+		{"bad token", url, http.Header{"Authorization": {"Bearer nope"}}, http.StatusUnauthorized},
+		{"no credentials", url, nil, http.StatusUnauthorized},
+	} {
+		ws, resp, err := websocket.DefaultDialer.Dial(test.url, test.header)
+		if test.status != 0 {
+			if err == nil || resp == nil || resp.StatusCode != test.status {
+				t.Errorf("%s: expected status %d: %v", test.name, test.status, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: dial failed: %v", test.name, err)
+		}
+		if g, e := whoami(t, ws), "alice"; g != e {
+			t.Errorf("%s: wrong principal: %q != %q", test.name, g, e)
+		}
+		ws.Close()
+	}
+}
+
+func TestLogin(t *testing.T) {
+	registry := birpc.NewRegistry()
+	registry.RegisterService(Whoami{})
+	server := wetsock.NewServer(registry, wetsock.Bearer(verifyToken))
+	server.Login = func(args json.RawMessage) (*birpc.Principal, error) {
+		var token string
+		if err := json.Unmarshal(args, &token); err != nil {
+			return nil, err
+		}
+		return verifyToken(token)
+	}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	ws.WriteJSON(birpc.Message{ID: 1, Func: wetsock.LoginMethod, Args: "sekrit"})
+	var reply birpc.Message
+	if err := ws.ReadJSON(&reply); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if reply.Error != nil || reply.Result != "alice" {
+		t.Fatalf("login failed: %#v", reply)
+	}
+	if g, e := whoami(t, ws), "alice"; g != e {
+		t.Errorf("wrong principal: %q != %q", g, e)
+	}
+	ws.Close()
+
+	// anything but a login is refused
+	ws, _, err = websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer ws.Close()
+	ws.WriteJSON(birpc.Message{ID: 1, Func: "Whoami.Name", Args: struct{}{}})
+	reply = birpc.Message{}
+	if err := ws.ReadJSON(&reply); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if reply.Error == nil || reply.Error.Msg != "Login required." {
+		t.Errorf("expected a login error: %#v", reply)
+	}
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Errorf("connection still open")
+	}
+}
+
+// chanLogger passes each event logged to a channel, as
+// "LEVEL msg args", dropping them when it is full.
+type chanLogger chan string
+
+func (l chanLogger) log(level, msg string, args ...interface{}) {
+	select {
+	case l <- fmt.Sprint(level, " ", msg, " ", args):
+	default:
+	}
+}
+
+func (l chanLogger) Debug(msg string, args ...interface{}) { l.log("DEBUG", msg, args...) }
+func (l chanLogger) Info(msg string, args ...interface{})  { l.log("INFO", msg, args...) }
+func (l chanLogger) Warn(msg string, args ...interface{})  { l.log("WARN", msg, args...) }
+func (l chanLogger) Error(msg string, args ...interface{}) { l.log("ERROR", msg, args...) }
+
+func TestLoginFailed(t *testing.T) {
+	registry := birpc.NewRegistry()
+	registry.RegisterService(Whoami{})
+	server := wetsock.NewServer(registry, nil)
+	server.Login = func(args json.RawMessage) (*birpc.Principal, error) {
+		var token string
+		if err := json.Unmarshal(args, &token); err != nil {
+			return nil, err
+		}
+		return verifyToken(token)
+	}
+	logged := make(chanLogger, 10)
+	server.Setup = func(e *birpc.Endpoint) {
+		e.SetLogger(logged)
+	}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer ws.Close()
+	ws.WriteJSON(birpc.Message{ID: 1, Func: wetsock.LoginMethod, Args: "nope"})
+	var reply birpc.Message
+	if err := ws.ReadJSON(&reply); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	// the reason is not for the peer
+	if reply.Error == nil || reply.Error.Msg != "Login failed." {
+		t.Errorf("expected a login error: %#v", reply)
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line := <-logged:
+			if strings.HasPrefix(line, "WARN wetsock: connection failed") {
+				if !strings.Contains(line, "bad token") {
+					t.Errorf("login failure not logged: %q", line)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("login failure not logged")
+		}
+	}
+}
+
+func TestServerSetupCodec(t *testing.T) {
+	registry := birpc.NewRegistry()
+	registry.RegisterService(WordLength{})
+	server := wetsock.NewServer(registry, nil)
+	server.SetupCodec = func(c wetsock.Codec) error {
+		c.SetLimits(200, 0)
+		return nil
+	}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer ws.Close()
+	client := wetsock.NewEndpoint(nil, ws)
+	go client.Serve()
+
+	reply := &Reply{}
+	err = client.Call("WordLength.Len", &Request{strings.Repeat("x", 1000)}, reply)
+	if err == nil {
+		t.Fatalf("limits not set")
+	}
+	if err := client.Call("WordLength.Len", &Request{"abc"}, reply); err != nil || reply.Length != 3 {
+		t.Fatalf("call failed: %+v %v", reply, err)
+	}
+}
+
+func TestHelloBeforeLogin(t *testing.T) {
+	registry := birpc.NewRegistry()
+	registry.RegisterService(Whoami{})
+	server := wetsock.NewServer(registry, nil)
+	server.Login = func(args json.RawMessage) (*birpc.Principal, error) {
+		return &birpc.Principal{Name: "bob"}, nil
+	}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer ws.Close()
+	client := wetsock.NewEndpoint(nil, ws)
+	client.SetHello(birpc.DefaultHello())
+	go client.Serve()
+
+	select {
+	case <-client.HandshakeDone():
+	case <-time.After(5 * time.Second):
+		t.Fatal("no handshake")
+	}
+	if !client.Capabilities().Has(birpc.FeatureErrorCodes) {
+		t.Errorf("hello was not answered: %+v", client.Capabilities())
+	}
+	var name string
+	if err := client.Call(wetsock.LoginMethod, nil, &name); err != nil || name != "bob" {
+		t.Fatalf("login failed: %q %v", name, err)
+	}
+	if err := client.Call("Whoami.Name", struct{}{}, &name); err != nil || name != "bob" {
+		t.Errorf("wrong principal: %q %v", name, err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	registry := birpc.NewRegistry()
+	registry.RegisterService(WordLength{})
+
+	upgrader := websocket.Upgrader{}
+	server_err := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ws, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		codec := wetsock.NewCodec(ws)
+		codec.SetLimits(200, 3)
+		server_err <- birpc.NewEndpoint(codec, registry).Serve()
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	type response struct {
+		ID     uint64
+		Result Reply
+		Error  *birpc.Error
+	}
+
+	// error codes are only sent once negotiated
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"id": 9, "fn": "birpc.hello", "args": {"version": 1, "features": ["error-codes"]}}`))
+	var hello response
+	if err := ws.ReadJSON(&hello); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	for _, req := range []string{
+		`{"id": 1, "fn": "WordLength.Len", "args": {"Word": "` + strings.Repeat("x", 1000) + `"}}`,
+		`{"id": 2, "fn": "WordLength.Len", "args": {"Word": [[[["a"]]]]}}`,
+	} {
+		ws.WriteMessage(websocket.TextMessage, []byte(req))
+		var reply response
+		if err := ws.ReadJSON(&reply); err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if reply.Error == nil || reply.Error.Code != birpc.CodeInvalidRequest {
+			t.Fatalf("expected an invalid request error: %+v", reply)
+		}
+	}
+
+	// the connection is still usable
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"id": 3, "fn": "WordLength.Len", "args": {"Word": "abc"}}`))
+	var reply response
+	if err := ws.ReadJSON(&reply); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if reply.ID != 3 || reply.Result.Length != 3 {
+		t.Fatalf("unexpected reply: %+v", reply)
+	}
+
+	// in a batch, only the request too deep is refused
+	ws.WriteMessage(websocket.TextMessage, []byte(`[{"id": 4, "fn": "WordLength.Len", "args": {"Word": [[[["a"]]]]}}, {"id": 5, "fn": "WordLength.Len", "args": {"Word": "abcd"}}]`))
+	got := map[uint64]response{}
+	for i := 0; i < 2; i++ {
+		var reply response
+		if err := ws.ReadJSON(&reply); err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		got[reply.ID] = reply
+	}
+	if e := got[4].Error; e == nil || e.Code != birpc.CodeInvalidRequest {
+		t.Fatalf("expected an invalid request error: %+v", got[4])
+	}
+	if r := got[5]; r.Error != nil || r.Result.Length != 4 {
+		t.Fatalf("unexpected reply: %+v", r)
+	}
+
+	// nothing to answer
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"result": "`+strings.Repeat("x", 1000)+`"}`))
+	err = <-server_err
+	var tooLarge *birpc.MessageTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("expected MessageTooLargeError: %v", err)
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	registry := birpc.NewRegistry()
+	registry.RegisterService(WordLength{})
+
+	upgrader := websocket.Upgrader{}
+	server_err := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ws, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		codec := wetsock.NewCodec(ws)
+		codec.SetLimits(200, 0)
+		server_err <- birpc.NewEndpoint(codec, registry).Serve()
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer ws.Close()
+
+	// too large to be skipped, even though it could be answered
+	go func() {
+		w, err := ws.NextWriter(websocket.TextMessage)
+		if err != nil {
+			return
+		}
+		io.WriteString(w, `{"id": 1, "fn": "WordLength.Len", "args": {"Word": "`)
+		chunk := []byte(strings.Repeat("x", 4096))
+		for n := 0; n <= wetsock.DrainSize; n += len(chunk) {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+		io.WriteString(w, `"}}`)
+		w.Close()
+	}()
+	select {
+	case err := <-server_err:
+		var tooLarge *birpc.MessageTooLargeError
+		if !errors.As(err, &tooLarge) || tooLarge.Max != 200 {
+			t.Fatalf("expected MessageTooLargeError: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server kept reading")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	registry := birpc.NewRegistry()
+	registry.RegisterService(WordLength{})
+
+	upgrader := websocket.Upgrader{}
+	server_err := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ws, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		codec := wetsock.NewCodec(ws)
+		codec.SetTimeouts(birpc.Timeouts{Idle: 200 * time.Millisecond, Write: time.Second})
+		server_err <- birpc.NewEndpoint(codec, registry).Serve()
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// activity keeps the connection open
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		ws.WriteMessage(websocket.TextMessage, []byte(`{"id": 1, "fn": "WordLength.Len", "args": {"Word": "a"}}`))
+		var reply struct{ Result Reply }
+		if err := ws.ReadJSON(&reply); err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+	}
+
+	select {
+	case err := <-server_err:
+		var timeout *birpc.TimeoutError
+		if !errors.As(err, &timeout) || timeout.Op != "idle" {
+			t.Fatalf("expected an idle TimeoutError: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection was not closed")
+	}
+}